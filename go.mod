@@ -0,0 +1,8 @@
+module github.com/sensyn-robotics/vaultenv
+
+go 1.14
+
+require (
+	github.com/aws/aws-sdk-go v1.46.7
+	golang.org/x/crypto v0.12.0
+)
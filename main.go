@@ -1,121 +1,400 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
-	"errors"
+	"bytes"
+	"context"
+	"flag"
 	"fmt"
 	"io"
-	"net/http"
-	"net/url"
+	"io/ioutil"
 	"os"
+	"os/signal"
 	"strings"
-	"text/template"
+	"syscall"
 	"time"
-)
 
-type httpClient interface {
-	Do(req *http.Request) (*http.Response, error)
-}
-type fetcher struct {
-	client httpClient
-	token  string
-}
+	"github.com/sensyn-robotics/vaultenv/render"
+)
 
 func main() {
-	client := &http.Client{
-		Timeout: time.Second * 5,
+	failFast := flag.Bool("fail-fast", true, "stop at the first line that fails to render")
+	concurrency := flag.Int("concurrency", 8, "number of secrets fetched concurrently")
+	maxPerVault := flag.Int("max-per-vault", 4, "number of secrets fetched concurrently from a single vault, 0 for no limit")
+	format := flag.String("format", "dotenv", "output format: dotenv, json or sh")
+	exportSh := flag.Bool("export-sh", false, "write shell export statements to eval, same as --format sh")
+	stripExport := flag.Bool("strip-export", false, "remove the export prefix of KEY=value lines")
+	envPrefix := flag.String("env-prefix", "", "write only the KEY=value lines whose key starts with the prefix")
+	stripPrefix := flag.Bool("strip-prefix", false, "remove the --env-prefix from the written keys")
+	outputPrefix := flag.String("output-prefix", "", "prepend the prefix to the keys of the written KEY=value lines")
+	mergeEnv := flag.Bool("merge-env", false, "fill the KEY=value lines rendered with an empty value with the environment variable KEY, when set")
+	sortKeys := flag.Bool("sort-keys", false, "sort the written KEY=value lines by key, moving the comments before a line with it")
+	merge := flag.Bool("merge", false, "let the keys of later template files override those of earlier files")
+	validateKeys := flag.Bool("validate-keys", false, "fail when a key is not a shell variable name")
+	noDuplicates := flag.Bool("no-duplicates", false, "fail when a key is defined more than once")
+	noTrailingNewline := flag.Bool("no-trailing-newline", false, "remove the newline at the end of the output")
+	wholeFile := flag.Bool("whole-file", false, "render the whole input as one template instead of line by line, e.g. for YAML")
+	lineMode := flag.Bool("line-mode", true, "render the input line by line with errors reported per line, --line-mode=false is --whole-file")
+	includeTemplate := flag.String("include-template", "", "comma separated files of named templates that the input can execute with the template action")
+	valueOnly := flag.Bool("value-only", false, "write the rendered value of a single line template without a newline, e.g. PASS=$(echo '{{ kv \"<url>\" }}' | vaultenv --value-only)")
+	maxLineBytes := flag.Int("max-line-bytes", 4<<20, "maximum length of a template line, 0 for no limit")
+	inlineComments := flag.Bool("inline-comments", false, "end the template of a line at an unquoted # preceded by white space")
+	reportJSON := flag.Bool("report-json", false, "write a JSON array of the results of the secret references to stderr instead of the error")
+	annotate := flag.Bool("annotate", false, "append a comment with the versions of the Key Vault secrets to each line")
+	quote := flag.Bool("quote", false, "wrap the values of KEY=value lines in double quotes")
+	cacheToken := flag.Bool("cache-token", false, "reuse the Azure AD tokens of earlier runs until they expire")
+	authOnly := flag.String("auth-only", "", "comma separated Azure credentials to try, in order, and no others: clientsecret, certificate, workload, managed, cli or devicecode")
+	authTimeout := flag.Duration("auth-timeout", 5*time.Second, "time limit for the managed identity endpoint to answer before the next Azure credential is tried, unlimited when 0")
+	interactive := flag.Bool("interactive", false, "sign in with a device code prompted on stderr when no other Azure credential is available, with a --timeout of 5m by default")
+	summary := flag.Bool("summary", false, "write the number of fetched secrets, of vaults and of cache hits, and the time spent to stderr at the end")
+	progress := flag.Bool("progress", false, "write the number of fetched secrets to stderr while they are fetched")
+	verbose := flag.Bool("verbose", false, "log credentials, fetched secret names and timings to stderr")
+	allowMissing := flag.Bool("allow-missing", false, "render secrets that do not exist as empty values instead of failing")
+	cacheTTL := flag.Duration("cache-ttl", 0, "reuse the secrets fetched by earlier runs for this long, stored in the user cache directory, not cached when 0")
+	noCache := flag.Bool("no-cache", false, "fetch a secret for every reference to it instead of once, e.g. to verify a rotation")
+	mask := flag.Bool("mask", false, "write fetched secrets as ******")
+	timeout := flag.Duration("timeout", 30*time.Second, "time limit for fetching a secret")
+	transforms := flag.String("transform", "", "comma separated transforms applied to every secret value, like urlencode")
+	secretNewline := flag.String("secret-newline", "", "normalize the line endings of the secret values: lf, or strip to remove them")
+	deadline := flag.Duration("deadline", 0, "time limit for fetching all the secrets, unlimited when 0")
+	vault := flag.String("vault", os.Getenv("VAULTENV_DEFAULT_VAULT"), "Key Vault name or url of the references that are secret names")
+	vaultSuffixes := flag.String("vault-suffixes", "", "comma separated DNS suffixes of the allowed Key Vault hosts, replacing those of the known clouds")
+	maxRetries := flag.Int("max-retries", 3, "number of retries of a throttled or failed Key Vault request")
+	redact := flag.String("redact", "", "write the rendered .env file with the secrets of the template replaced by their references")
+	diff := flag.String("diff", "", "compare the rendered .env with the given .env by key, without showing the values, and fail when they differ")
+	listRefs := flag.Bool("list-refs", false, "print the secrets referenced by the templates, without fetching them")
+	check := flag.Bool("check", false, "check that every referenced secret can be read, without rendering")
+	dryRun := flag.Bool("dry-run", false, "validate the template and the secret urls without fetching secrets")
+	delims := flag.String("delims", "", "template action delimiters separated by a space, e.g. \"<< >>\"")
+	flag.Parse()
+	args := flag.Args()
+	command := ""
+	if len(args) > 0 && (args[0] == "exec" || args[0] == "set" || args[0] == "ping") {
+		command = args[0]
+		flag.CommandLine.Parse(args[1:])
+		args = flag.Args()
 	}
-	filter(fetcher{client, ""}, os.Stdin, os.Stdout)
-}
 
-func filter(f fetcher, in io.Reader, out io.Writer) {
-	t := template.New(".env").Funcs(template.FuncMap{
-		"kv": f.fetch,
-	})
-	scanner := bufio.NewScanner(in)
-	for scanner.Scan() {
-		if err := scanner.Err(); err != nil {
-			panic(err)
+	opts := render.Options{
+		CacheTokens:       *cacheToken,
+		Interactive:       *interactive,
+		Deadline:          *deadline,
+		SecretNewline:     *secretNewline,
+		Timeout:           *timeout,
+		AuthTimeout:       *authTimeout,
+		DefaultVault:      *vault,
+		MaxRetries:        *maxRetries,
+		DryRun:            *dryRun,
+		AllowMissing:      *allowMissing,
+		Mask:              *mask,
+		CacheTTL:          *cacheTTL,
+		NoCache:           *noCache,
+		KeepGoing:         !*failFast || *dryRun,
+		Concurrency:       *concurrency,
+		MaxPerVault:       *maxPerVault,
+		Format:            *format,
+		StripExport:       *stripExport,
+		EnvPrefix:         *envPrefix,
+		StripPrefix:       *stripPrefix,
+		OutputPrefix:      *outputPrefix,
+		NoDuplicates:      *noDuplicates,
+		ValidateKeys:      *validateKeys,
+		Merge:             *merge,
+		SortKeys:          *sortKeys,
+		MergeEnv:          *mergeEnv,
+		NoTrailingNewline: *noTrailingNewline,
+		WholeFile:         *wholeFile || !*lineMode,
+		Quote:             *quote,
+		ValueOnly:         *valueOnly,
+		MaxLineBytes:      *maxLineBytes,
+		Annotate:          *annotate,
+		InlineComments:    *inlineComments,
+	}
+	if *exportSh {
+		if isFlagSet("format") && *format != "sh" {
+			fatal(fmt.Errorf("--export-sh writes --format sh, not %s", *format))
 		}
-		line := scanner.Text()
-		if line != "" {
-			err := template.Must(t.Parse(line)).Execute(out, nil)
-			if err != nil {
-				panic(err)
-			}
+		*format = "sh"
+		opts.Format = "sh"
+	}
+	if *format != "dotenv" && *format != "json" && *format != "sh" {
+		fatal(fmt.Errorf("unknown --format %q", *format))
+	}
+	if *delims != "" {
+		d := strings.Fields(*delims)
+		if len(d) != 2 {
+			fatal(fmt.Errorf("--delims must be a left and a right delimiter separated by a space: %q", *delims))
 		}
-		out.Write([]byte{'\n'})
+		opts.LeftDelim, opts.RightDelim = d[0], d[1]
 	}
-}
-
-func (f *fetcher) fetch(rawurl string) (string, error) {
-	url, err := url.Parse(rawurl)
+	if *wholeFile && *lineMode && isFlagSet("line-mode") {
+		fatal(fmt.Errorf("--whole-file and --line-mode can not be used together"))
+	}
+	if *interactive && !isFlagSet("timeout") {
+		// leave time to sign in
+		opts.Timeout = 5 * time.Minute
+	}
+	if *includeTemplate != "" {
+		opts.Templates = strings.Split(*includeTemplate, ",")
+	}
+	if *vaultSuffixes != "" {
+		opts.VaultSuffixes = strings.Split(*vaultSuffixes, ",")
+	}
+	if *authOnly != "" {
+		opts.AuthOrder = strings.Split(*authOnly, ",")
+	}
+	if *transforms != "" {
+		opts.Transforms = strings.Split(*transforms, ",")
+	}
+	if *reportJSON {
+		opts.Report = os.Stderr
+	}
+	if *verbose {
+		opts.Log = os.Stderr
+	}
+	if *progress {
+		opts.Progress = os.Stderr
+	}
+	r, err := render.New(opts)
 	if err != nil {
-		return "", err
+		fatal(err)
+	}
+	ctx := signalContext()
+	printSummary := func() {
+		if *summary {
+			fmt.Fprintf(os.Stderr, "vaultenv: %s\n", r.Summary())
+		}
+	}
+	if command == "exec" {
+		code, err := r.Exec(ctx, os.Stdin, args)
+		printSummary()
+		if err != nil {
+			// interrupted before the command started
+			exitIfInterrupted(ctx)
+			fatal(err)
+		}
+		os.Exit(code)
+	}
+	if command == "set" {
+		err := setSecret(ctx, r, args)
+		exitIfInterrupted(ctx)
+		if err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if command == "ping" {
+		err := ping(ctx, r, args)
+		exitIfInterrupted(ctx)
+		if err != nil {
+			fatal(err)
+		}
+		return
 	}
-	if !strings.HasSuffix(url.Hostname(), "vault.azure.net") {
-		return "", fmt.Errorf("Invalid url - %s", rawurl)
+	if *listRefs {
+		if err := listFiles(r, args); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if *check {
+		err := checkFiles(ctx, r, args)
+		printSummary()
+		exitIfInterrupted(ctx)
+		if err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if *diff != "" && *format != "dotenv" {
+		fatal(fmt.Errorf("--diff compares the dotenv output, not --format %s", *format))
+	}
+	// The output is rendered in memory first so that nothing partial is
+	// written when interrupted or failing, unless --fail-fast=false asks
+	// for the failed lines unrendered.
+	var rendered bytes.Buffer
+	if len(args) > 0 {
+		err = r.RenderFiles(ctx, args, &rendered)
+	} else {
+		err = r.Render(ctx, os.Stdin, &rendered)
+	}
+	printSummary()
+	exitIfInterrupted(ctx)
+	if *redact == "" && *diff == "" && (err == nil || !*failFast) {
+		os.Stdout.Write(rendered.Bytes())
+	}
+	if err != nil && *reportJSON {
+		// the errors are in the report
+		os.Exit(1)
 	}
-	b, err := f.getToken()
 	if err != nil {
-		return "", err
+		fatal(err)
+	}
+	if *redact != "" {
+		if err := redactFile(r, *redact); err != nil {
+			fatal(err)
+		}
+	}
+	if *diff != "" {
+		if err := diffFile(r, &rendered, *diff); err != nil {
+			fatal(err)
+		}
+	}
+}
+
+// signalContext returns a context canceled on SIGINT or SIGTERM, which
+// stops the fetches in progress. A second signal terminates as usual,
+// unless the command of exec runs, which receives the signals instead.
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ch
+		signal.Stop(ch)
+		cancel()
+	}()
+	return ctx
+}
+
+// exitIfInterrupted exits with 130 as a shell does when ctx was canceled
+// by a signal.
+func exitIfInterrupted(ctx context.Context) {
+	if ctx.Err() != nil {
+		fmt.Fprintln(os.Stderr, "vaultenv: interrupted")
+		os.Exit(130)
 	}
-	req, err := http.NewRequest("GET", rawurl+"?api-version=7.0", nil)
+}
+
+// diffFile compares the rendered .env with the .env file path.
+func diffFile(r *render.Renderer, rendered io.Reader, path string) error {
+	file, err := os.Open(path)
 	if err != nil {
-		return "", err
+		return err
 	}
-	req.Header.Add("Authorization", "Bearer "+b)
-	req.Header.Add("Accept", "application/json")
-	res, err := f.client.Do(req)
+	defer file.Close()
+	return r.Diff(rendered, file, os.Stdout)
+}
+
+// redactFile writes the rendered .env file path with the secrets replaced
+// by their references.
+func redactFile(r *render.Renderer, path string) error {
+	file, err := os.Open(path)
 	if err != nil {
-		return "", err
+		return err
 	}
-	if res.StatusCode != 200 {
-		return "", fmt.Errorf("GET %s - %s", url, res.Status)
+	defer file.Close()
+	return r.Redact(file, os.Stdout)
+}
+
+// setSecret stores the value of args, <url> [value], into Key Vault and
+// prints the new version. The value is read from stdin when not given.
+func setSecret(ctx context.Context, r *render.Renderer, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: vaultenv set <url> [value]")
 	}
-	defer res.Body.Close()
-	var result struct {
-		Value string `json:"value"`
+	var value string
+	if len(args) == 2 {
+		value = args[1]
+	} else {
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		value = strings.TrimSuffix(strings.TrimSuffix(string(b), "\n"), "\r")
 	}
-	decoder := json.NewDecoder(res.Body)
-	if err = decoder.Decode(&result); err != nil {
-		return "", err
+	version, err := r.Set(ctx, args[0], value)
+	if err != nil {
+		return err
 	}
+	fmt.Println(version)
+	return nil
+}
 
-	return result.Value, nil
+// ping checks that the vault of args, <vault>, can be listed with the
+// credentials, and prints the credential used and the time it took.
+func ping(ctx context.Context, r *render.Renderer, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: vaultenv ping <vault>")
+	}
+	start := time.Now()
+	credential, err := r.Ping(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: ok in %v with credential %s\n", args[0], time.Since(start).Round(time.Millisecond), credential)
+	return nil
 }
 
-func (f *fetcher) getToken() (string, error) {
-	if f.token != "" {
-		return f.token, nil
-	}
-	var req *http.Request
-	if clientId := os.Getenv("VAULTENV_AZURE_USER"); clientId != "" {
-		values := url.Values{}
-		values.Set("grant_type", "client_credentials")
-		values.Add("client_id", clientId)
-		values.Add("client_secret", os.Getenv("VAULTENV_AZURE_PASSWORD"))
-		values.Add("resource", "https://vault.azure.net")
-		req, _ = http.NewRequest("GET", fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/token", os.Getenv("VAULTENV_AZURE_TENANT")), strings.NewReader(values.Encode()))
-		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	} else {
-		req, _ = http.NewRequest("GET", "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2019-06-04&resource=https%3A%2F%2Fvault.azure.net", nil)
-		req.Header.Add("Metadata", "true")
+// listFiles prints the distinct secrets referenced by the template files
+// paths, or stdin when there are none.
+func listFiles(r *render.Renderer, paths []string) error {
+	var refs []string
+	if len(paths) == 0 {
+		var err error
+		if refs, err = r.Refs(os.Stdin); err != nil {
+			return err
+		}
+	}
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		fileRefs, err := r.Refs(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		refs = append(refs, fileRefs...)
+	}
+	seen := map[string]bool{}
+	for _, ref := range refs {
+		if !seen[ref] {
+			seen[ref] = true
+			fmt.Println(ref)
+		}
 	}
-	res, err := f.client.Do(req)
-	if res.StatusCode != 200 {
-		return "", errors.New(res.Status)
+	return nil
+}
+
+// checkFiles checks the template files paths, or stdin when there are
+// none.
+func checkFiles(ctx context.Context, r *render.Renderer, paths []string) error {
+	if len(paths) == 0 {
+		return r.Check(ctx, os.Stdin, os.Stdout)
 	}
-	defer res.Body.Close()
-	var auth struct {
-		Token string `json:"access_token"`
+	failed := 0
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s:\n", path)
+		err = r.Check(ctx, file, os.Stdout)
+		file.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "vaultenv: %s: %v\n", path, err)
+			failed++
+		}
 	}
-	decoder := json.NewDecoder(res.Body)
-	if err = decoder.Decode(&auth); err != nil {
-		return "", err
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed the check", failed, len(paths))
 	}
-	f.token = auth.Token
+	return nil
+}
+
+// isFlagSet reports whether the flag name is given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
 
-	return auth.Token, nil
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "vaultenv: %v\n", err)
+	os.Exit(1)
 }
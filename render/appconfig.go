@@ -0,0 +1,124 @@
+package render
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// appConfigKeyVaultRef is the content type of the App Configuration
+// values that are references to Key Vault secrets.
+const appConfigKeyVaultRef = "application/vnd.microsoft.appconfig.keyvaultref+json"
+
+// appConfigBackend fetches key-values from Azure App Configuration
+// referenced as appconfig://<store>.azconfig.io/<key>?label=<label>, with
+// the Azure credentials. Values that are Key Vault references are
+// resolved to their secrets.
+type appConfigBackend struct {
+	client HTTPClient
+	azure  *azureBackend
+}
+
+// appConfigKey returns the key of u.
+func appConfigKey(u *url.URL) (string, error) {
+	key := strings.TrimPrefix(u.Path, "/")
+	if key == "" {
+		return "", fmt.Errorf("Invalid url - %s: want appconfig://<store>.azconfig.io/<key>", u)
+	}
+	return key, nil
+}
+
+func (c *appConfigBackend) Validate(u *url.URL) error {
+	if _, err := appConfigKey(u); err != nil {
+		return err
+	}
+	for _, cloud := range azureClouds {
+		if inDomain(u.Hostname(), cloud.appConfigSuffix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid url - %s: host %s is not an App Configuration host", u, u.Hostname())
+}
+
+func (c *appConfigBackend) Fetch(ctx context.Context, u *url.URL) (string, error) {
+	if err := c.Validate(u); err != nil {
+		return "", err
+	}
+	key, _ := appConfigKey(u)
+	endpoint := "https://" + u.Host + "/kv/" + url.PathEscape(key)
+	query := url.Values{"api-version": {"1.0"}}
+	if label := u.Query().Get("label"); label != "" {
+		query.Set("label", label)
+	}
+	req, err := http.NewRequest("GET", endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	// App Configuration takes tokens for the endpoint of the store.
+	t, err := c.azure.credentialFor(u.Hostname()).token(ctx, "https://"+u.Host)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Add("Authorization", "Bearer "+t.value)
+	req.Header.Add("Accept", "application/vnd.microsoft.appconfig.kv+json, application/problem+json")
+	res, err := c.azure.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	decoder := json.NewDecoder(res.Body)
+	if res.StatusCode != 200 {
+		var e struct {
+			Title  string `json:"title"`
+			Detail string `json:"detail"`
+		}
+		decoder.Decode(&e)
+		status := res.Status
+		if e.Detail != "" {
+			status += ": " + e.Detail
+		}
+		return "", &responseError{
+			method:     "GET",
+			url:        endpoint,
+			status:     status,
+			statusCode: res.StatusCode,
+			code:       e.Title,
+			requestID:  res.Header.Get("X-Ms-Request-Id"),
+			secret:     key,
+		}
+	}
+	var kv struct {
+		ContentType string `json:"content_type"`
+		Value       string `json:"value"`
+	}
+	if err := decoder.Decode(&kv); err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(kv.ContentType, appConfigKeyVaultRef) {
+		return kv.Value, nil
+	}
+	return c.keyVaultRef(ctx, key, kv.Value)
+}
+
+// keyVaultRef returns the secret of the Key Vault reference value of key.
+func (c *appConfigBackend) keyVaultRef(ctx context.Context, key, value string) (string, error) {
+	var ref struct {
+		URI string `json:"uri"`
+	}
+	if err := json.Unmarshal([]byte(value), &ref); err != nil {
+		return "", fmt.Errorf("key %q is an invalid Key Vault reference: %v", key, err)
+	}
+	u, err := url.Parse(ref.URI)
+	if err != nil {
+		return "", fmt.Errorf("key %q is an invalid Key Vault reference: %v", key, err)
+	}
+	v, err := c.azure.Fetch(ctx, lowerHost(u))
+	if err != nil {
+		return "", fmt.Errorf("key %q references a Key Vault secret: %w", key, err)
+	}
+	return v, nil
+}
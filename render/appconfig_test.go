@@ -0,0 +1,44 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestAppConfig(t *testing.T) {
+	var b bytes.Buffer
+	template := `GREETING={{ kv "appconfig://config.azconfig.io/app/greeting" }}
+PROD_GREETING={{ kv "appconfig://CONFIG.azconfig.io/app/greeting?label=prod" }}
+DB_PASSWORD={{ kv "appconfig://config.azconfig.io/db-password" }}
+MISSING={{ kvOr "appconfig://config.azconfig.io/missing" "none" }}
+`
+	expected := `GREETING=hello
+PROD_GREETING=hello-prod
+DB_PASSWORD=mysecretvalue1
+MISSING=none
+`
+	r := strings.NewReader(template)
+	if err := filter(context.Background(), newFetcher(&dummyClient{}), r, &b, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != expected {
+		t.Fatalf("got:%s want:%s", b.String(), expected)
+	}
+}
+
+func TestAppConfigErrors(t *testing.T) {
+	for rawurl, expected := range map[string]string{
+		"appconfig://config.azconfig.io/missing":                  "404",
+		"appconfig://config.azconfig.io/lookalike":                `key "lookalike" references a Key Vault secret: Invalid url - https://vault.example.com/secrets/pass`,
+		"appconfig://config.example.com/app":                      "is not an App Configuration host",
+		"appconfig://config.azconfig.io/":                         "want appconfig://<store>.azconfig.io/<key>",
+		"https://example.vault.azure.net/secrets/pass?label=prod": "label is an option of App Configuration references only",
+	} {
+		_, err := newFetcher(&dummyClient{}).fetch(context.Background(), rawurl)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%s: got:%v want:%s", rawurl, err, expected)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package render
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// awsBackend fetches secrets from AWS Secrets Manager referenced by ARN,
+// optionally followed by the :SecretString:json-key:version-stage:version-id:
+// suffix used by ECS. The region is taken from the ARN, and the credentials
+// from the default chain of the AWS SDK.
+type awsBackend struct {
+	client HTTPClient
+
+	mu      sync.Mutex
+	session *session.Session
+}
+
+type awsSecretRef struct {
+	partition    string
+	region       string
+	secretID     string
+	jsonKey      string
+	versionStage string
+	versionID    string
+}
+
+func parseAwsSecretRef(u *url.URL) (*awsSecretRef, error) {
+	parts := strings.Split(u.Opaque, ":")
+	if len(parts) < 6 || parts[1] != "secretsmanager" || parts[4] != "secret" || parts[2] == "" || parts[5] == "" {
+		return nil, fmt.Errorf("Invalid url - %s", u)
+	}
+	ref := &awsSecretRef{
+		partition: parts[0],
+		region:    parts[2],
+		secretID:  "arn:" + strings.Join(parts[:6], ":"),
+	}
+	if rest := parts[6:]; len(rest) > 0 {
+		if rest[0] != "SecretString" {
+			return nil, fmt.Errorf("Invalid url - %s: unexpected %q after secret name", u, rest[0])
+		}
+		rest = append(rest[1:], "", "", "")
+		ref.jsonKey, ref.versionStage, ref.versionID = rest[0], rest[1], rest[2]
+	}
+	return ref, nil
+}
+
+func (a *awsBackend) Validate(u *url.URL) error {
+	_, err := parseAwsSecretRef(u)
+	return err
+}
+
+func (a *awsBackend) Fetch(ctx context.Context, u *url.URL) (string, error) {
+	ref, err := parseAwsSecretRef(u)
+	if err != nil {
+		return "", err
+	}
+	sess, err := a.loadSession()
+	if err != nil {
+		return "", err
+	}
+	input := &secretsmanager.GetSecretValueInput{SecretId: aws.String(ref.secretID)}
+	if ref.versionStage != "" {
+		input.VersionStage = aws.String(ref.versionStage)
+	}
+	if ref.versionID != "" {
+		input.VersionId = aws.String(ref.versionID)
+	}
+	client := secretsmanager.New(sess, aws.NewConfig().WithRegion(ref.region))
+	result, err := client.GetSecretValueWithContext(ctx, input)
+	if e, ok := err.(awserr.RequestFailure); ok {
+		return "", &responseError{
+			method:     "GetSecretValue",
+			url:        ref.secretID,
+			status:     fmt.Sprintf("%d %s: %s %s", e.StatusCode(), http.StatusText(e.StatusCode()), e.Code(), e.Message()),
+			statusCode: e.StatusCode(),
+			code:       e.Code(),
+			requestID:  e.RequestID(),
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if result.SecretString == nil {
+		return "", fmt.Errorf("%s has no SecretString", ref.secretID)
+	}
+	if ref.jsonKey == "" {
+		return *result.SecretString, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(*result.SecretString), &fields); err != nil {
+		return "", fmt.Errorf("%s is not a JSON secret: %v", ref.secretID, err)
+	}
+	v, ok := fields[ref.jsonKey]
+	if !ok {
+		return "", fmt.Errorf("key %q not found in %s", ref.jsonKey, ref.secretID)
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// loadSession returns the AWS session shared by the fetches, created on
+// first use with the shared config files, so that the credentials of the
+// environment, of the profiles, with credential_process, SSO or roles to
+// assume, of web identity tokens, of ECS tasks and of EC2 instances are
+// found as with the AWS CLI.
+func (a *awsBackend) loadSession() (*session.Session, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.session != nil {
+		return a.session, nil
+	}
+	transport := http.RoundTripper(clientTransport{a.client})
+	if c, ok := a.client.(*http.Client); ok {
+		if t, ok := c.Transport.(*http.Transport); ok {
+			// a copy, as the SDK replaces the CA certificates of its
+			// transport by those of AWS_CA_BUNDLE
+			transport = t.Clone()
+		}
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            aws.Config{HTTPClient: &http.Client{Transport: transport}},
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("AWS credentials: %v", err)
+	}
+	a.session = sess
+	return sess, nil
+}
+
+// clientTransport sends the requests of the AWS SDK with the HTTP client of
+// the fetcher.
+type clientTransport struct {
+	client HTTPClient
+}
+
+func (t clientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.client.Do(req)
+}
@@ -0,0 +1,162 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// awsEnv are the environment variables of the AWS credential chain, unset
+// by setAwsEnv so that the tests do not depend on those of the machine.
+var awsEnv = []string{
+	"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE", "AWS_REGION",
+	"AWS_ROLE_ARN", "AWS_WEB_IDENTITY_TOKEN_FILE",
+	"AWS_CONTAINER_CREDENTIALS_FULL_URI", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_AUTHORIZATION_TOKEN",
+	"AWS_EC2_METADATA_DISABLED", "AWS_EC2_METADATA_SERVICE_ENDPOINT", "AWS_CA_BUNDLE",
+}
+
+// setAwsEnv sets the environment variables vars without the shared config
+// files, and returns the function restoring the environment.
+func setAwsEnv(vars map[string]string) func() {
+	saved := map[string]string{}
+	for _, k := range append(awsEnv, "AWS_CONFIG_FILE", "AWS_SHARED_CREDENTIALS_FILE") {
+		if v, ok := os.LookupEnv(k); ok {
+			saved[k] = v
+		}
+		os.Unsetenv(k)
+	}
+	os.Setenv("AWS_CONFIG_FILE", filepath.Join(os.TempDir(), "vaultenv-no-aws-config"))
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(os.TempDir(), "vaultenv-no-aws-credentials"))
+	for k, v := range vars {
+		os.Setenv(k, v)
+	}
+	return func() {
+		for _, k := range append(awsEnv, "AWS_CONFIG_FILE", "AWS_SHARED_CREDENTIALS_FILE") {
+			os.Unsetenv(k)
+		}
+		for k, v := range saved {
+			os.Setenv(k, v)
+		}
+	}
+}
+
+// awsClient answers the requests of Secrets Manager with dummyClient and
+// those of STS with the credentials of AKIDEXAMPLE for the web identity
+// token "web-identity-token", and sends the others to the test servers.
+type awsClient struct {
+	dummyClient
+}
+
+func (c *awsClient) Do(req *http.Request) (*http.Response, error) {
+	if strings.HasPrefix(req.URL.Host, "sts.") {
+		req.ParseForm()
+		status, body := 200, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>AKIDEXAMPLE</AccessKeyId>
+      <SecretAccessKey>web-identity-secret</SecretAccessKey>
+      <SessionToken>web-identity-session</SessionToken>
+      <Expiration>2100-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`
+		if req.PostForm.Get("Action") != "AssumeRoleWithWebIdentity" || req.PostForm.Get("WebIdentityToken") != "web-identity-token" || req.PostForm.Get("RoleArn") != "arn:aws:iam::123456789012:role/app" {
+			status, body = 403, `<ErrorResponse><Error><Code>AccessDenied</Code><Message>denied</Message></Error></ErrorResponse>`
+		}
+		return &http.Response{StatusCode: status, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+	}
+	if strings.HasSuffix(req.URL.Host, ".amazonaws.com") {
+		return c.dummyClient.Do(req)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestAwsSecretsManager(t *testing.T) {
+	defer setAwsEnv(map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKIDEXAMPLE",
+		"AWS_SECRET_ACCESS_KEY": "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	})()
+
+	var b bytes.Buffer
+	template := `PASSWORD={{ kv "arn:aws:secretsmanager:us-east-1:123456789012:secret:mysecret" }}
+USER={{ kv "arn:aws:secretsmanager:us-east-1:123456789012:secret:myjson:SecretString:username:" }}
+`
+	expected := `PASSWORD=mysecretvalue4
+USER=jsonuser
+`
+	r := strings.NewReader(template)
+	if err := filter(context.Background(), newFetcher(&dummyClient{}), r, &b, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != expected {
+		t.Fatalf("got:%s want:%s", b.String(), expected)
+	}
+}
+
+func TestAwsCredentialChain(t *testing.T) {
+	credentials := `{"AccessKeyId": "AKIDEXAMPLE", "SecretAccessKey": "secret", "Token": "session", "Expiration": "2100-01-01T00:00:00Z"}`
+	ecs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "ecs-token" {
+			w.WriteHeader(401)
+			return
+		}
+		w.Write([]byte(credentials))
+	}))
+	defer ecs.Close()
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "PUT" && r.URL.Path == "/latest/api/token":
+			w.Header().Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", r.Header.Get("X-Aws-Ec2-Metadata-Token-Ttl-Seconds"))
+			w.Write([]byte("imds-token"))
+		case r.Header.Get("X-Aws-Ec2-Metadata-Token") != "imds-token":
+			w.WriteHeader(401)
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/":
+			w.Write([]byte("app-role"))
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/app-role":
+			w.Write([]byte(`{"Code": "Success", "AccessKeyId": "AKIDEXAMPLE", "SecretAccessKey": "secret", "Token": "session", "Expiration": "2100-01-01T00:00:00Z"}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer imds.Close()
+	dir := writeFiles(t, map[string]string{"token": "web-identity-token"})
+	defer os.RemoveAll(dir)
+
+	for name, vars := range map[string]map[string]string{
+		"web identity": {
+			"AWS_REGION":                  "us-east-1",
+			"AWS_ROLE_ARN":                "arn:aws:iam::123456789012:role/app",
+			"AWS_WEB_IDENTITY_TOKEN_FILE": filepath.Join(dir, "token"),
+		},
+		"ECS": {
+			"AWS_CONTAINER_CREDENTIALS_FULL_URI": ecs.URL + "/credentials",
+			"AWS_CONTAINER_AUTHORIZATION_TOKEN":  "ecs-token",
+		},
+		"EC2": {
+			"AWS_EC2_METADATA_SERVICE_ENDPOINT": imds.URL,
+		},
+	} {
+		restore := setAwsEnv(vars)
+		v, err := newFetcher(&awsClient{}).fetch(context.Background(), "arn:aws:secretsmanager:us-east-1:123456789012:secret:mysecret")
+		restore()
+		if err != nil || v != "mysecretvalue4" {
+			t.Fatalf("%s: got:%s, %v want:mysecretvalue4", name, v, err)
+		}
+	}
+}
+
+func TestInvalidAwsArn(t *testing.T) {
+	var b bytes.Buffer
+	template := `PASSWORD={{ kv "arn:aws:s3:::bucket" }}
+`
+	r := strings.NewReader(template)
+	if err := filter(context.Background(), newFetcher(&dummyClient{}), r, &b, Options{}); err == nil {
+		t.Fatalf("must be error")
+	}
+}
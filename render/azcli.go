@@ -0,0 +1,114 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// azureCliTokenProvider gets tokens of the account logged in with the
+// Azure CLI by running az account get-access-token.
+type azureCliTokenProvider struct {
+	// command is the az executable, az in PATH when empty.
+	command string
+	// subscription or else tenant selects the account of the token, the
+	// default subscription when both are empty.
+	subscription string
+	tenant       string
+	// retryDelay overrides the delay before retrying a failed az when
+	// positive.
+	retryDelay time.Duration
+}
+
+// azureCliAttempts is the number of times az is run when it fails for a
+// reason other than the account not being logged in, like a token
+// refresh in progress.
+const azureCliAttempts = 2
+
+func (p *azureCliTokenProvider) String() string {
+	return "Azure CLI"
+}
+
+func (p *azureCliTokenProvider) token(ctx context.Context, resource string) (accessToken, error) {
+	command := p.command
+	if command == "" {
+		command = "az"
+	}
+	path, err := exec.LookPath(command)
+	if err != nil {
+		return accessToken{}, notAvailable(command + " is not found in PATH")
+	}
+	delay := p.retryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	var out []byte
+	for attempt := 1; ; attempt++ {
+		var transient bool
+		out, transient, err = getAccessToken(ctx, path, p.args(resource))
+		if err == nil || !transient || attempt == azureCliAttempts {
+			break
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return accessToken{}, ctx.Err()
+		}
+	}
+	if err != nil {
+		return accessToken{}, err
+	}
+	var auth struct {
+		AccessToken string          `json:"accessToken"`
+		ExpiresOn   json.RawMessage `json:"expires_on"`
+		// ExpiresOnLocal is the expiry in local time, given by older
+		// versions of the Azure CLI only.
+		ExpiresOnLocal string `json:"expiresOn"`
+	}
+	if err := json.Unmarshal(out, &auth); err != nil {
+		return accessToken{}, fmt.Errorf("az account get-access-token: %v", err)
+	}
+	t := accessToken{value: auth.AccessToken}
+	if on, err := jsonSeconds(auth.ExpiresOn); err == nil {
+		t.expiresOn = time.Unix(on, 0)
+	} else if on, err := time.ParseInLocation("2006-01-02 15:04:05.999999", auth.ExpiresOnLocal, time.Local); err == nil {
+		t.expiresOn = on
+	}
+	return t, nil
+}
+
+// args returns the arguments of az to get a token of resource. The
+// subscription implies its tenant, and az takes only one of them.
+func (p *azureCliTokenProvider) args(resource string) []string {
+	args := []string{"account", "get-access-token", "--resource", resource, "--output", "json"}
+	if p.subscription != "" {
+		args = append(args, "--subscription", p.subscription)
+	} else if p.tenant != "" {
+		args = append(args, "--tenant", p.tenant)
+	}
+	return args
+}
+
+// getAccessToken runs az account get-access-token of path with args once.
+// A failure is transient unless the account is not logged in or az can
+// not run.
+func getAccessToken(ctx context.Context, path string, args []string) (out []byte, transient bool, err error) {
+	cmd := exec.CommandContext(ctx, path, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err = cmd.Output()
+	if err == nil {
+		return out, false, nil
+	}
+	msg := strings.TrimSpace(stderr.String())
+	if msg == "" {
+		msg = err.Error()
+	}
+	_, exited := err.(*exec.ExitError)
+	transient = exited && ctx.Err() == nil && !strings.Contains(msg, "az login")
+	return nil, transient, fmt.Errorf("az account get-access-token failed: %s", msg)
+}
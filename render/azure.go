@@ -0,0 +1,402 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// azureBackend fetches secrets from Azure Key Vault.
+type azureBackend struct {
+	client HTTPClient
+	cred   tokenProvider
+	// vaultCreds replace cred for the vaults they match.
+	vaultCreds []vaultCredential
+	// cloud is the Azure cloud of the credential.
+	cloud azureCloud
+	// scope overrides the Key Vault resource of cloud that tokens are
+	// requested for when set, like https://vault.azure.net/.default.
+	scope string
+	// warn reports references to a vault of another cloud once per host.
+	warn   *log.Logger
+	warned sync.Map
+	// maxRetries is the number of times a throttled or failed request is
+	// retried.
+	maxRetries int
+	// backoff is the delay before the first retry when the response has
+	// no Retry-After header. It doubles on every retry.
+	backoff time.Duration
+	// logger reports the retries.
+	logger *log.Logger
+	// suffixes replaces the DNS suffixes of the vaults of the known
+	// clouds as the allowed vault hosts when set.
+	suffixes []string
+	// versions holds the versions of the fetched secrets, keyed on their
+	// url.
+	versions sync.Map
+}
+
+// maxRetryDelay bounds the wait before a retry, whatever the Retry-After
+// header of the response.
+const maxRetryDelay = 30 * time.Second
+
+// latestVersion is the version marker selecting the newest enabled
+// version of a secret.
+const latestVersion = "@latest"
+
+func (a *azureBackend) Validate(u *url.URL) error {
+	if err := a.checkHost(u.Hostname()); err != nil {
+		return fmt.Errorf("Invalid url - %s: %v", u, err)
+	}
+	if cloud, ok := vaultCloud(u.Hostname()); ok && cloud != a.cloud {
+		if _, warned := a.warned.LoadOrStore(u.Host, true); !warned {
+			a.warn.Printf("%s is a vault of the %s cloud, but VAULTENV_AZURE_CLOUD is %s", u.Host, cloud.name, a.cloud.name)
+		}
+	}
+	_, _, err := secretPath(u)
+	return err
+}
+
+// azureSecret is a secret bundle of Key Vault.
+type azureSecret struct {
+	ID          string            `json:"id"`
+	Value       string            `json:"value"`
+	ContentType string            `json:"contentType"`
+	Tags        map[string]string `json:"tags"`
+}
+
+func (a *azureBackend) Fetch(ctx context.Context, u *url.URL) (string, error) {
+	s, err := a.secret(ctx, u)
+	if err != nil {
+		return "", err
+	}
+	return s.Value, nil
+}
+
+// secret fetches the secret bundle with the value and the properties of
+// the secret.
+func (a *azureBackend) secret(ctx context.Context, u *url.URL) (*azureSecret, error) {
+	if err := a.Validate(u); err != nil {
+		return nil, err
+	}
+	name, version, _ := secretPath(u)
+	vault := "https://" + u.Host
+	if version == latestVersion {
+		var err error
+		version, err = a.latestEnabledVersion(ctx, vault, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	endpoint := vault + "/secrets/" + name
+	if version != "" {
+		endpoint += "/" + version
+	}
+	var result azureSecret
+	if err := a.get(ctx, endpoint+"?api-version=7.0", &result); err != nil {
+		if e, ok := err.(*responseError); ok {
+			e.secret = name
+		}
+		return nil, err
+	}
+	if result.ID != "" {
+		a.versions.Store(u.String(), result.ID[strings.LastIndex(result.ID, "/")+1:])
+	}
+	return &result, nil
+}
+
+// latestEnabledVersion lists the versions of the secret and returns the
+// most recently created one that is enabled.
+func (a *azureBackend) latestEnabledVersion(ctx context.Context, vault, name string) (string, error) {
+	var latest struct {
+		id      string
+		created int64
+	}
+	next := vault + "/secrets/" + name + "/versions?api-version=7.0"
+	for next != "" {
+		var page struct {
+			Value []struct {
+				ID         string `json:"id"`
+				Attributes struct {
+					Enabled bool  `json:"enabled"`
+					Created int64 `json:"created"`
+				} `json:"attributes"`
+			} `json:"value"`
+			NextLink string `json:"nextLink"`
+		}
+		if err := a.get(ctx, next, &page); err != nil {
+			return "", err
+		}
+		for _, v := range page.Value {
+			if !v.Attributes.Enabled {
+				continue
+			}
+			if v.Attributes.Created > latest.created || (v.Attributes.Created == latest.created && v.ID > latest.id) {
+				latest.id, latest.created = v.ID, v.Attributes.Created
+			}
+		}
+		next = page.NextLink
+	}
+	if latest.id == "" {
+		return "", fmt.Errorf("secret %q has no enabled version", name)
+	}
+	return latest.id[strings.LastIndex(latest.id, "/")+1:], nil
+}
+
+// secretNames lists the names of the enabled secrets of vault.
+func (a *azureBackend) secretNames(ctx context.Context, vault string) ([]string, error) {
+	var names []string
+	next := vault + "/secrets?api-version=7.0"
+	for next != "" {
+		var page struct {
+			Value []struct {
+				ID         string `json:"id"`
+				Attributes struct {
+					Enabled bool `json:"enabled"`
+				} `json:"attributes"`
+			} `json:"value"`
+			NextLink string `json:"nextLink"`
+		}
+		if err := a.get(ctx, next, &page); err != nil {
+			return nil, err
+		}
+		for _, v := range page.Value {
+			if v.Attributes.Enabled {
+				names = append(names, v.ID[strings.LastIndex(v.ID, "/")+1:])
+			}
+		}
+		next = page.NextLink
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// resource is the resource tokens are requested for, the Key Vault
+// resource of the cloud unless a scope is set.
+func (a *azureBackend) resource() string {
+	if a.scope != "" {
+		return strings.TrimSuffix(a.scope, "/.default")
+	}
+	return a.cloud.keyVaultResource()
+}
+
+// setSecret stores value as a new version of the secret u and returns
+// the version.
+func (a *azureBackend) setSecret(ctx context.Context, u *url.URL, value string) (string, error) {
+	if err := a.Validate(u); err != nil {
+		return "", err
+	}
+	name, version, _ := secretPath(u)
+	if version != "" {
+		return "", fmt.Errorf("Invalid url - %s: a secret to set has no version", u)
+	}
+	body, err := json.Marshal(map[string]string{"value": value})
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		ID string `json:"id"`
+	}
+	if err := a.request(ctx, "PUT", "https://"+u.Host+"/secrets/"+name+"?api-version=7.0", body, &result); err != nil {
+		if e, ok := err.(*responseError); ok {
+			e.secret = name
+		}
+		return "", err
+	}
+	return result.ID[strings.LastIndex(result.ID, "/")+1:], nil
+}
+
+// get sends an authenticated GET request to Key Vault and decodes the
+// JSON response into v.
+func (a *azureBackend) get(ctx context.Context, endpoint string, v interface{}) error {
+	return a.request(ctx, "GET", endpoint, nil, v)
+}
+
+// request sends an authenticated request with the JSON body, if any, to
+// Key Vault and decodes the JSON response into v.
+func (a *azureBackend) request(ctx context.Context, method, endpoint string, body []byte, v interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, endpoint, reqBody)
+	if err != nil {
+		return err
+	}
+	t, err := a.credentialFor(req.URL.Hostname()).token(ctx, a.resource())
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Add("Authorization", "Bearer "+t.value)
+	req.Header.Add("Accept", "application/json")
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	res, err := a.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		var e struct {
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		json.NewDecoder(res.Body).Decode(&e)
+		return &responseError{
+			method:     method,
+			url:        strings.Split(endpoint, "?")[0],
+			status:     res.Status,
+			statusCode: res.StatusCode,
+			code:       e.Error.Code,
+			requestID:  res.Header.Get("X-Ms-Request-Id"),
+		}
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// do sends req and retries it on throttling, server errors and timeouts.
+func (a *azureBackend) do(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		res, err := a.client.Do(req)
+		delay, retry := a.retryDelay(req.Context(), attempt, res, err)
+		if !retry || attempt >= a.maxRetries {
+			return res, err
+		}
+		reason := fmt.Sprint(err)
+		if res != nil {
+			reason = res.Status
+			res.Body.Close()
+		}
+		a.logger.Printf("retrying %s %s in %v after %s", req.Method, req.URL.Host+req.URL.Path, delay, reason)
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// retryDelay reports whether the result of a request should be retried
+// and how long to wait before that, at most maxRetryDelay and the time left
+// before the deadline of ctx.
+func (a *azureBackend) retryDelay(ctx context.Context, attempt int, res *http.Response, err error) (time.Duration, bool) {
+	if err != nil {
+		netErr, ok := err.(net.Error)
+		return 0, ok && netErr.Timeout() && ctx.Err() == nil
+	}
+	if res.StatusCode != http.StatusTooManyRequests && res.StatusCode < 500 {
+		return 0, false
+	}
+	backoff := a.backoff
+	if backoff == 0 {
+		backoff = time.Second
+	}
+	delay := backoff << uint(attempt)
+	if delay > maxRetryDelay || delay < backoff {
+		delay = maxRetryDelay
+	}
+	if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+		delay = maxRetryDelay
+		if seconds < int(maxRetryDelay/time.Second) {
+			delay = time.Duration(seconds) * time.Second
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		delay = time.Until(deadline)
+	}
+	return delay, true
+}
+
+// secretURL returns the url of the secret name of vault in the cloud of
+// the backend, of the version when not empty.
+func (a *azureBackend) secretURL(vault, name, version string) string {
+	rawurl := fmt.Sprintf("https://%s.%s/secrets/%s", vault, a.cloud.vaultSuffix, name)
+	if version != "" {
+		rawurl += "/" + version
+	}
+	return rawurl
+}
+
+// validateVault checks that u is the url of a vault, without a path.
+func (a *azureBackend) validateVault(u *url.URL) error {
+	if u.Scheme != "https" || (u.Path != "" && u.Path != "/") {
+		return fmt.Errorf("Invalid vault url - %s", u)
+	}
+	if err := a.checkHost(u.Hostname()); err != nil {
+		return fmt.Errorf("Invalid vault url - %s: %v", u, err)
+	}
+	return nil
+}
+
+// checkHost checks that host is in a domain of the allowed vault
+// suffixes, so that secrets are not requested with Key Vault tokens from
+// lookalike hosts.
+func (a *azureBackend) checkHost(host string) error {
+	suffixes := a.suffixes
+	if len(suffixes) == 0 {
+		for _, c := range azureClouds {
+			suffixes = append(suffixes, c.vaultSuffix)
+		}
+	}
+	for _, suffix := range suffixes {
+		if inDomain(host, suffix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("host %s is not a Key Vault host of .%s", host, strings.Join(suffixes, ", ."))
+}
+
+// secretNamePattern matches the names of Key Vault secrets, and
+// secretVersionPattern their versions.
+var (
+	secretNamePattern    = regexp.MustCompile(`^[0-9a-zA-Z-]{1,127}$`)
+	secretVersionPattern = regexp.MustCompile(`^[0-9a-zA-Z]+$`)
+)
+
+// secretPath splits the path of a Key Vault secret identifier,
+// /secrets/<name>[/<version>], into its name and version. The segments
+// are decoded, and a trailing slash is ignored.
+func secretPath(u *url.URL) (name, version string, err error) {
+	parts := strings.Split(strings.TrimSuffix(u.EscapedPath(), "/"), "/")
+	if len(parts) < 3 || len(parts) > 4 || parts[0] != "" || parts[1] != "secrets" {
+		return "", "", fmt.Errorf("Invalid url - %s: the path must be /secrets/<name>[/<version>]", u)
+	}
+	for i, p := range parts[2:] {
+		if parts[2+i], err = url.PathUnescape(p); err != nil {
+			return "", "", fmt.Errorf("Invalid url - %s: %v", u, err)
+		}
+	}
+	name = parts[2]
+	if !secretNamePattern.MatchString(name) {
+		return "", "", fmt.Errorf("Invalid url - %s: invalid secret name %q, must be 1 to 127 alphanumerics or dashes", u, name)
+	}
+	if len(parts) == 4 {
+		version = parts[3]
+		if version != latestVersion && !secretVersionPattern.MatchString(version) {
+			return "", "", fmt.Errorf("Invalid url - %s: invalid secret version %q", u, version)
+		}
+	}
+	return name, version, nil
+}
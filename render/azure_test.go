@@ -0,0 +1,322 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLatestEnabledVersion(t *testing.T) {
+	var b bytes.Buffer
+	template := `PASSWORD={{ kv "https://example.vault.azure.net/secrets/rotated/@latest" }}
+`
+	expected := `PASSWORD=rotated-v2
+`
+	r := strings.NewReader(template)
+	if err := filter(context.Background(), newFetcher(&dummyClient{}), r, &b, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != expected {
+		t.Fatalf("got:%s want:%s", b.String(), expected)
+	}
+}
+
+// flakyClient answers the first failures requests with status.
+type flakyClient struct {
+	dummyClient
+	status     int
+	retryAfter string
+	failures   int
+}
+
+func (c *flakyClient) Do(req *http.Request) (*http.Response, error) {
+	if strings.HasPrefix(req.URL.Path, "/secrets/") && c.failures > 0 {
+		c.failures--
+		c.requests = append(c.requests, req.URL.String())
+		res := &http.Response{
+			Status:     fmt.Sprintf("%d %s", c.status, http.StatusText(c.status)),
+			StatusCode: c.status,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(`{"error": {"code": "Throttled"}}`)),
+		}
+		if c.retryAfter != "" {
+			res.Header.Set("Retry-After", c.retryAfter)
+		}
+		return res, nil
+	}
+	return c.dummyClient.Do(req)
+}
+
+func TestRetry(t *testing.T) {
+	for _, c := range []*flakyClient{
+		{status: 429, retryAfter: "0", failures: 2},
+		{status: 503, failures: 3},
+	} {
+		f := newFetcher(c)
+		f.azure.maxRetries = 3
+		f.azure.backoff = time.Millisecond
+		v, err := f.fetch(context.Background(), "https://example.vault.azure.net/secrets/pass")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != "mysecretvalue1" {
+			t.Fatalf("got:%s want:mysecretvalue1", v)
+		}
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	for _, c := range []*flakyClient{
+		{status: 429, retryAfter: "0", failures: 5},
+		{status: 403, failures: 1},
+	} {
+		f := newFetcher(c)
+		f.azure.maxRetries = 3
+		f.azure.backoff = time.Millisecond
+		if _, err := f.fetch(context.Background(), "https://example.vault.azure.net/secrets/pass"); err == nil {
+			t.Fatalf("%d: must be error", c.status)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	a := newFetcher(&dummyClient{}).azure
+	a.backoff = time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, c := range []struct {
+		ctx        context.Context
+		attempt    int
+		retryAfter string
+		max        time.Duration
+		min        time.Duration
+	}{
+		{context.Background(), 0, "0", 0, 0},
+		{context.Background(), 0, "3", 3 * time.Second, 3 * time.Second},
+		{context.Background(), 0, "3600", maxRetryDelay, maxRetryDelay},
+		{context.Background(), 10, "", maxRetryDelay, maxRetryDelay},
+		{ctx, 0, "3600", 10 * time.Second, 9 * time.Second},
+	} {
+		res := &http.Response{StatusCode: 429, Header: http.Header{}}
+		if c.retryAfter != "" {
+			res.Header.Set("Retry-After", c.retryAfter)
+		}
+		delay, retry := a.retryDelay(c.ctx, c.attempt, res, nil)
+		if !retry || delay < c.min || delay > c.max {
+			t.Fatalf("%s: got:%v, %v want:%v", c.retryAfter, delay, retry, c.max)
+		}
+	}
+
+	var b bytes.Buffer
+	f := newFetcher(&flakyClient{status: 429, retryAfter: "0", failures: 1})
+	f.logger.SetOutput(&b)
+	f.azure.maxRetries = 1
+	if _, err := f.fetch(context.Background(), "https://example.vault.azure.net/secrets/pass"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "vaultenv: retrying GET example.vault.azure.net/secrets/pass in 0s after 429 Too Many Requests\n"
+	if !strings.Contains(b.String(), expected) {
+		t.Fatalf("got:%s want:%s", b.String(), expected)
+	}
+}
+
+func TestRequestIDInError(t *testing.T) {
+	f := newFetcher(&dummyClient{})
+	_, err := f.fetch(context.Background(), "https://example.vault.azure.net/secrets/forbidden")
+	expected := `fetch "forbidden" failed: 403 Forbidden (request-id: abc123)`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("got:%v want:%s", err, expected)
+	}
+}
+
+func TestAzureCloud(t *testing.T) {
+	os.Setenv("VAULTENV_AZURE_CLOUD", "usgov")
+	defer os.Unsetenv("VAULTENV_AZURE_CLOUD")
+	c := &dummyClient{}
+	f := newFetcher(c)
+	var warn bytes.Buffer
+	f.azure.warn.SetOutput(&warn)
+	v, err := f.fetch(context.Background(), "https://example.vault.usgovcloudapi.net/secrets/pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "mysecretvalue1" {
+		t.Fatalf("got:%s want:mysecretvalue1", v)
+	}
+	if !strings.Contains(c.requests[0], "resource=https%3A%2F%2Fvault.usgovcloudapi.net") {
+		t.Fatalf("got:%s want:usgov resource", c.requests[0])
+	}
+	if warn.Len() != 0 {
+		t.Fatalf("got:%s want:no warning", warn.String())
+	}
+
+	u, _ := url.Parse("https://example.vault.azure.net/secrets/pass")
+	for i := 0; i < 2; i++ {
+		if err := f.azure.Validate(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := "vaultenv: warning: example.vault.azure.net is a vault of the public cloud, but VAULTENV_AZURE_CLOUD is usgov\n"
+	if warn.String() != expected {
+		t.Fatalf("got:%s want:%s", warn.String(), expected)
+	}
+
+	os.Setenv("VAULTENV_AZURE_CLOUD", "mars")
+	if _, err := azureCloudFromEnv(); err == nil {
+		t.Fatal("unknown cloud must be an error")
+	}
+}
+
+func TestVaultHost(t *testing.T) {
+	f := newFetcher(&dummyClient{})
+	for rawurl, valid := range map[string]bool{
+		"https://example.vault.azure.net/secrets/pass":          true,
+		"https://example.vault.azure.cn/secrets/pass":           true,
+		"https://example.vault.azure.net.evil.com/secrets/pass": false,
+		"https://examplevault.azure.net/secrets/pass":           false,
+		"https://vault.azure.net/secrets/pass":                  false,
+	} {
+		u, _ := url.Parse(rawurl)
+		f.azure.warn.SetOutput(ioutil.Discard)
+		if err := f.azure.Validate(u); (err == nil) != valid {
+			t.Fatalf("got:%v want valid:%v for %s", err, valid, rawurl)
+		}
+	}
+
+	f.azure.suffixes = []string{"vault.example.internal"}
+	u, _ := url.Parse("https://example.vault.example.internal/secrets/pass")
+	if err := f.azure.Validate(u); err != nil {
+		t.Fatal(err)
+	}
+	u, _ = url.Parse("https://example.vault.azure.net/secrets/pass")
+	err := f.azure.Validate(u)
+	if err == nil || !strings.Contains(err.Error(), "is not a Key Vault host of .vault.example.internal") {
+		t.Fatalf("got:%v want:not a Key Vault host", err)
+	}
+}
+
+func TestSecretPath(t *testing.T) {
+	for _, c := range []struct {
+		rawurl, name, version, err string
+	}{
+		{"https://example.vault.azure.net/secrets/pass", "pass", "", ""},
+		{"https://example.vault.azure.net/secrets/pass/", "pass", "", ""},
+		{"https://example.vault.azure.net/secrets/pass/v1/", "pass", "v1", ""},
+		{"https://example.vault.azure.net/secrets/db%2Dpassword/@latest", "db-password", "@latest", ""},
+		{"https://example.vault.azure.net/secrets/", "", "", "the path must be /secrets/<name>[/<version>]"},
+		{"https://example.vault.azure.net/secrets//v1", "", "", `invalid secret name ""`},
+		{"https://example.vault.azure.net/secrets/pass//", "", "", `invalid secret version ""`},
+		{"https://example.vault.azure.net/secrets/a%2Fb", "", "", `invalid secret name "a/b"`},
+		{"https://example.vault.azure.net/secrets/pass/v%20", "", "", `invalid secret version "v "`},
+		{"https://example.vault.azure.net/secrets/pass/v1/extra", "", "", "the path must be /secrets/<name>[/<version>]"},
+		{"https://example.vault.azure.net/keys/pass", "", "", "the path must be /secrets/<name>[/<version>]"},
+	} {
+		u, err := url.Parse(c.rawurl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, version, err := secretPath(u)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) || !strings.Contains(err.Error(), c.rawurl) {
+				t.Fatalf("got:%v want:%s for %s", err, c.err, c.rawurl)
+			}
+			continue
+		}
+		if err != nil || name != c.name || version != c.version {
+			t.Fatalf("got:%s, %s, %v want:%s, %s for %s", name, version, err, c.name, c.version, c.rawurl)
+		}
+	}
+
+	v, err := newFetcher(&dummyClient{}).fetch(context.Background(), "https://example.vault.azure.net/secrets/pa%73s/")
+	if err != nil || v != "mysecretvalue1" {
+		t.Fatalf("got:%s, %v want:mysecretvalue1", v, err)
+	}
+}
+
+func TestSetSecret(t *testing.T) {
+	f := newFetcher(&dummyClient{})
+	version, err := f.set(context.Background(), "https://example.vault.azure.net/secrets/new", "newvalue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "4387e9f3d6e14c459867679a90fd0f79" {
+		t.Fatalf("got:%s want:4387e9f3d6e14c459867679a90fd0f79", version)
+	}
+
+	for rawurl, expected := range map[string]string{
+		"https://example.vault.azure.net/secrets/new/v1": "a secret to set has no version",
+		"https://example.com/secrets/new":                "is not a Key Vault host",
+		"vault://hashicorp.example.com/secret/data/app":  "only Key Vault secrets can be set",
+	} {
+		if _, err := f.set(context.Background(), rawurl, "newvalue"); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("got:%v want:%s", err, expected)
+		}
+	}
+}
+
+// resourceCredential records the resources tokens are requested for.
+type resourceCredential struct {
+	mu        sync.Mutex
+	resources []string
+}
+
+func (c *resourceCredential) Token(ctx context.Context, resource string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resources = append(c.resources, resource)
+	return "TOKEN_WITH_VM_IDENTITY", nil
+}
+
+func TestVaultScope(t *testing.T) {
+	os.Setenv("VAULTENV_VAULT_SCOPE", "https://vault.example.com/.default")
+	defer os.Unsetenv("VAULTENV_VAULT_SCOPE")
+	cred := &resourceCredential{}
+	r, err := New(Options{Client: &dummyClient{}, Credential: cred})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := r.Render(context.Background(), strings.NewReader(`PASSWORD={{ kv "https://example.vault.azure.net/secrets/pass" }}`), &b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cred.resources, []string{"https://vault.example.com"}) {
+		t.Fatalf("got:%v want:[https://vault.example.com]", cred.resources)
+	}
+}
+
+func TestPing(t *testing.T) {
+	os.Setenv("VAULTENV_AZURE_USER", "b3a0fa1e-2a56-44c5-9ec1-f95921243ed7")
+	os.Setenv("VAULTENV_AZURE_PASSWORD", "7a724b98-f30e-4991-a020-fb56d12277e1")
+	os.Setenv("VAULTENV_AZURE_TENANT", "5a9c134c-c9d6-4b9c-b588-94d3096dbf4c")
+	defer os.Unsetenv("VAULTENV_AZURE_USER")
+	defer os.Unsetenv("VAULTENV_AZURE_PASSWORD")
+	defer os.Unsetenv("VAULTENV_AZURE_TENANT")
+
+	f := newFetcher(&dummyClient{})
+	for _, vault := range []string{"all", "https://ALL.vault.azure.net/"} {
+		credential, err := f.ping(context.Background(), vault)
+		if err != nil || credential != "client secret" {
+			t.Fatalf("%s: got:%s, %v want:client secret", vault, credential, err)
+		}
+	}
+	if _, err := f.ping(context.Background(), "https://example.com"); err == nil || !strings.Contains(err.Error(), "Invalid vault url") {
+		t.Fatalf("got:%v want:Invalid vault url", err)
+	}
+
+	r, err := New(Options{Client: &dummyClient{}, Credential: staticCredential("TOKEN")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credential, err := r.Ping(context.Background(), "all"); err != nil || credential != "Options.Credential" {
+		t.Fatalf("got:%s, %v want:Options.Credential", credential, err)
+	}
+}
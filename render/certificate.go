@@ -0,0 +1,179 @@
+package render
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certificateTokenProvider authenticates a service principal with a
+// client assertion signed by the key of a PEM certificate file.
+type certificateTokenProvider struct {
+	client   HTTPClient
+	cloud    azureCloud
+	tenant   string
+	clientID string
+	path     string
+	password string
+
+	once sync.Once
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+	err  error
+}
+
+func (p *certificateTokenProvider) String() string {
+	return "client certificate"
+}
+
+func (p *certificateTokenProvider) cacheKey() string {
+	if p.clientID == "" || p.path == "" {
+		return ""
+	}
+	return p.cloud.authority + "/" + p.tenant + "/" + p.clientID + "/certificate"
+}
+
+func (p *certificateTokenProvider) token(ctx context.Context, resource string) (accessToken, error) {
+	if p.clientID == "" || p.path == "" {
+		return accessToken{}, notAvailable("set VAULTENV_AZURE_USER, VAULTENV_AZURE_TENANT and VAULTENV_AZURE_CERT_PATH")
+	}
+	p.once.Do(func() {
+		p.cert, p.key, p.err = loadCertificate(p.path, p.password)
+	})
+	if p.err != nil {
+		return accessToken{}, p.err
+	}
+	endpoint := p.cloud.tokenEndpoint(p.tenant)
+	assertion, err := p.assertion(endpoint, time.Now())
+	if err != nil {
+		return accessToken{}, err
+	}
+	values := url.Values{}
+	values.Set("grant_type", "client_credentials")
+	values.Add("client_id", p.clientID)
+	values.Add("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+	values.Add("client_assertion", assertion)
+	values.Add("resource", resource)
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return accessToken{}, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	return requestToken(ctx, p.client, req)
+}
+
+// assertion returns a JWT for aud signed with the certificate key.
+func (p *certificateTokenProvider) assertion(aud string, now time.Time) (string, error) {
+	thumbprint := sha1.Sum(p.cert.Raw)
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	return signJWT(p.key, map[string]interface{}{
+		"x5t": base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+	}, map[string]interface{}{
+		"aud": aud,
+		"iss": p.clientID,
+		"sub": p.clientID,
+		"jti": hex.EncodeToString(jti),
+		"nbf": now.Unix(),
+		"exp": now.Add(10 * time.Minute).Unix(),
+	})
+}
+
+// signJWT returns a JWT of claims signed by key with RS256. header is
+// added to the JOSE header.
+func signJWT(key *rsa.PrivateKey, header, claims map[string]interface{}) (string, error) {
+	h := map[string]interface{}{"alg": "RS256", "typ": "JWT"}
+	for k, v := range header {
+		h[k] = v
+	}
+	hb, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	cb, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(cb)
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// loadCertificate reads the certificate and the RSA private key of a PEM
+// file. Legacy encrypted keys are decrypted with password.
+func loadCertificate(path, password string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read certificate: %v", err)
+	}
+	var cert *x509.Certificate
+	var key *rsa.PrivateKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE" && cert == nil:
+			if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+				return nil, nil, fmt.Errorf("failed to parse certificate %s: %v", path, err)
+			}
+		case strings.HasSuffix(block.Type, "PRIVATE KEY") && key == nil:
+			if key, err = parsePrivateKey(block, password); err != nil {
+				return nil, nil, fmt.Errorf("failed to parse private key %s: %v", path, err)
+			}
+		}
+	}
+	if cert == nil || key == nil {
+		return nil, nil, fmt.Errorf("%s must be a PEM file with a certificate and its private key; convert PKCS#12 files with `openssl pkcs12 -nodes`", path)
+	}
+	return cert, key, nil
+}
+
+func parsePrivateKey(block *pem.Block, password string) (*rsa.PrivateKey, error) {
+	der := block.Bytes
+	if x509.IsEncryptedPEMBlock(block) {
+		var err error
+		if der, err = x509.DecryptPEMBlock(block, []byte(password)); err != nil {
+			return nil, err
+		}
+	}
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		return nil, errors.New("encrypted PKCS#8 keys are not supported")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("the private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
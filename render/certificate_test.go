@@ -0,0 +1,111 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate and its key to a PEM
+// file in dir.
+func writeCertificate(t *testing.T, dir string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "vaultenv"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	pem.Encode(&b, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pem.Encode(&b, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	path := filepath.Join(dir, "cert.pem")
+	if err := ioutil.WriteFile(path, b.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCertificateCredential(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vaultenv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("VAULTENV_AZURE_USER", "b3a0fa1e-2a56-44c5-9ec1-f95921243ed7")
+	os.Setenv("VAULTENV_AZURE_TENANT", "5a9c134c-c9d6-4b9c-b588-94d3096dbf4c")
+	os.Setenv("VAULTENV_AZURE_CERT_PATH", writeCertificate(t, dir))
+	defer os.Unsetenv("VAULTENV_AZURE_USER")
+	defer os.Unsetenv("VAULTENV_AZURE_TENANT")
+	defer os.Unsetenv("VAULTENV_AZURE_CERT_PATH")
+
+	v, err := newFetcher(&dummyClient{}).fetch(context.Background(), "https://example.vault.azure.net/secrets/pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "mysecretvalue6" {
+		t.Fatalf("got:%s want:mysecretvalue6", v)
+	}
+}
+
+func TestCertificateAssertion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vaultenv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key, err := loadCertificate(writeCertificate(t, dir), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &certificateTokenProvider{clientID: "client", cert: cert, key: key}
+	jwt, err := p.assertion("https://login.microsoftonline.com/tenant/oauth2/token", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("got:%s want:a JWT", jwt)
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), crypto.SHA256, hash[:], sig); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertificateCredentialInvalidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vaultenv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cert.pfx")
+	ioutil.WriteFile(path, []byte("not a pem file"), 0600)
+	p := &certificateTokenProvider{client: &dummyClient{}, cloud: azurePublicCloud, clientID: "client", path: path}
+	_, err = p.token(context.Background(), azurePublicCloud.keyVaultResource())
+	if err == nil || !strings.Contains(err.Error(), "must be a PEM file") {
+		t.Fatalf("got:%v want:descriptive error", err)
+	}
+}
@@ -0,0 +1,101 @@
+package render
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"text/template"
+)
+
+// Check fetches every secret referenced by the functions of the template
+// read from in, like kv, kvName or kvCert, and writes whether it is readable to out,
+// without the values. It fails when a secret can not be read. A missing
+// secret only referenced by kvOr passes, as it falls back.
+//
+// Only string literal references are checked, and included templates and
+// the named templates of Options.Templates are not followed.
+func (r *Renderer) Check(ctx context.Context, in io.Reader, out io.Writer) error {
+	ctx, cancel := r.f.withDeadline(ctx)
+	defer cancel()
+	lines, _, err := readLines(in)
+	if err != nil {
+		return err
+	}
+	funcs := funcMap(ctx, r.f, &source{}, r.opts)
+	t := template.New(".env").Delims(r.opts.LeftDelim, r.opts.RightDelim).Funcs(funcs)
+	if err := parseTemplates(t, r.opts.Templates); err != nil {
+		return hintFuncs(err, funcs)
+	}
+	var refs []secretRef
+	optional := map[string]bool{}
+	add := func(name, rawurl string) {
+		o, seen := optional[rawurl]
+		if !seen {
+			refs = append(refs, secretRef{rawurl, refFuncs[name].properties})
+		}
+		optional[rawurl] = (o || !seen) && name == "kvOr"
+	}
+	if r.opts.WholeFile {
+		tmpl, err := t.Parse(strings.Join(lines, "\n"))
+		if err != nil {
+			return hintFuncs(parsed(err), funcs)
+		}
+		r.f.walkRefs(tmpl.Tree.Root, add)
+	} else {
+		if r.opts.InlineComments {
+			for i, line := range lines {
+				lines[i], _ = splitInlineComment(line, r.opts.LeftDelim, r.opts.RightDelim)
+			}
+		}
+		r.f.refCalls(t, lines, add)
+	}
+
+	errs := make([]error, len(refs))
+	concurrency := r.opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	ch := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range ch {
+				errs[i] = r.f.load(ctx, refs[i])
+			}
+		}()
+	}
+	for i := range refs {
+		ch <- i
+	}
+	close(ch)
+	wg.Wait()
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	failed := 0
+	for i, ref := range refs {
+		rawurl := ref.rawurl
+		switch err := errs[i]; {
+		case err == nil:
+			fmt.Fprintf(w, "ok\t%s\n", rawurl)
+		case optional[rawurl] && isNotFound(err):
+			fmt.Fprintf(w, "missing\t%s\tkvOr falls back\n", rawurl)
+		case r.opts.AllowMissing && isNotFound(err):
+			fmt.Fprintf(w, "missing\t%s\trendered empty\n", rawurl)
+		default:
+			failed++
+			fmt.Fprintf(w, "failed\t%s\t%v\n", rawurl, err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d secrets can not be read", failed, len(refs))
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	template := `# {{ kv "https://example.vault.azure.net/secrets/commented" }}
+USER=foo@example.com
+PASSWORD={{ kv "https://example.vault.azure.net/secrets/pass" }}
+OPTIONAL={{ kvOr "https://example.vault.azure.net/secrets/missing" "none" }}
+FORBIDDEN={{ kv "https://example.vault.azure.net/secrets/forbidden" }}
+AGAIN={{ kv "https://example.vault.azure.net/secrets/pass" }}
+`
+	expected := `ok       https://example.vault.azure.net/secrets/pass
+missing  https://example.vault.azure.net/secrets/missing    kvOr falls back
+failed   https://example.vault.azure.net/secrets/forbidden  fetch "forbidden" failed: 403 Forbidden (request-id: abc123)
+`
+	r, err := New(Options{Client: &dummyClient{}, Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	err = r.Check(context.Background(), strings.NewReader(template), &b)
+	if err == nil || err.Error() != "1 of 3 secrets can not be read" {
+		t.Fatalf("got:%v want:1 of 3 secrets can not be read", err)
+	}
+	if b.String() != expected {
+		t.Fatalf("got:%s want:%s", b.String(), expected)
+	}
+	if strings.Contains(b.String(), "mysecretvalue1") {
+		t.Fatalf("values must not be written: %s", b.String())
+	}
+}
+
+func TestCheckRefFuncs(t *testing.T) {
+	template := `NAMED={{ kvName "example" "missing" }}
+VERSIONED={{ kvNameVersion "example" "rotated" "v2" }}
+OWNER={{ kvTag "https://example.vault.azure.net/secrets/tagged" "owner" }}
+CERT={{ kvCert "https://example.vault.azure.net/secrets/forbidden" }}
+`
+	r, err := New(Options{Client: &dummyClient{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	err = r.Check(context.Background(), strings.NewReader(template), &b)
+	if err == nil || err.Error() != "2 of 4 secrets can not be read" {
+		t.Fatalf("got:%v want:2 of 4 secrets can not be read", err)
+	}
+	expected := `failed  https://example.vault.azure.net/secrets/missing  fetch "missing" failed: 404 Not Found (request-id: abc123)
+ok      https://example.vault.azure.net/secrets/rotated/v2
+ok      https://example.vault.azure.net/secrets/tagged
+failed  https://example.vault.azure.net/secrets/forbidden  fetch "forbidden" failed: 403 Forbidden (request-id: abc123)
+`
+	if b.String() != expected {
+		t.Fatalf("got:%s want:%s", b.String(), expected)
+	}
+}
@@ -0,0 +1,34 @@
+package render
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// newHTTPClient returns the client used when Options.Client is nil. It
+// uses the proxies of HTTPS_PROXY and NO_PROXY, and trusts the CA
+// certificates of the PEM file VAULTENV_CA_BUNDLE in addition to the
+// system ones, e.g. behind a TLS intercepting proxy.
+func newHTTPClient() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if path := os.Getenv("VAULTENV_CA_BUNDLE"); path != "" {
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("VAULTENV_CA_BUNDLE: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("VAULTENV_CA_BUNDLE: no PEM certificate in %s", path)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,73 @@
+package render
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// azureCloud is the endpoints of an Azure cloud.
+type azureCloud struct {
+	name string
+	// authority is the Azure AD host tokens are requested from.
+	authority string
+	// vaultSuffix is the DNS suffix of the Key Vault hosts.
+	vaultSuffix string
+	// appConfigSuffix is the DNS suffix of the App Configuration hosts.
+	appConfigSuffix string
+}
+
+var (
+	azurePublicCloud = azureCloud{"public", "login.microsoftonline.com", "vault.azure.net", "azconfig.io"}
+	azureGovCloud    = azureCloud{"usgov", "login.microsoftonline.us", "vault.usgovcloudapi.net", "azconfig.azure.us"}
+	azureChinaCloud  = azureCloud{"china", "login.chinacloudapi.cn", "vault.azure.cn", "azconfig.azure.cn"}
+)
+
+var azureClouds = []azureCloud{azurePublicCloud, azureGovCloud, azureChinaCloud}
+
+// azureCloudFromEnv returns the cloud named by VAULTENV_AZURE_CLOUD, the
+// public cloud by default.
+func azureCloudFromEnv() (azureCloud, error) {
+	name := os.Getenv("VAULTENV_AZURE_CLOUD")
+	if name == "" {
+		return azurePublicCloud, nil
+	}
+	for _, c := range azureClouds {
+		if c.name == name {
+			return c, nil
+		}
+	}
+	return azurePublicCloud, fmt.Errorf("unknown VAULTENV_AZURE_CLOUD %q: must be public, usgov or china", name)
+}
+
+// keyVaultResource is the resource tokens are requested for to access
+// Key Vault.
+func (c azureCloud) keyVaultResource() string {
+	return "https://" + c.vaultSuffix
+}
+
+// tokenEndpoint is the OAuth2 token endpoint of tenant.
+func (c azureCloud) tokenEndpoint(tenant string) string {
+	return fmt.Sprintf("https://%s/%s/oauth2/token", c.authority, tenant)
+}
+
+// tokenEndpointV2 is the OAuth2 v2.0 token endpoint of tenant, which
+// takes scopes instead of resources.
+func (c azureCloud) tokenEndpointV2(tenant string) string {
+	return fmt.Sprintf("https://%s/%s/oauth2/v2.0/token", c.authority, tenant)
+}
+
+// vaultCloud returns the cloud a Key Vault host belongs to.
+func vaultCloud(host string) (azureCloud, bool) {
+	for _, c := range azureClouds {
+		if inDomain(host, c.vaultSuffix) {
+			return c, true
+		}
+	}
+	return azureCloud{}, false
+}
+
+// inDomain reports whether host is a subdomain of domain.
+func inDomain(host, domain string) bool {
+	return strings.HasSuffix(host, "."+strings.TrimPrefix(domain, "."))
+}
@@ -0,0 +1,438 @@
+package render
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenProvider acquires Azure AD access tokens.
+type tokenProvider interface {
+	token(ctx context.Context, resource string) (accessToken, error)
+}
+
+// accessToken is an access token and its expiry, zero when unknown.
+type accessToken struct {
+	value     string
+	expiresOn time.Time
+	// provider names the credential of the token in a chain.
+	provider string
+}
+
+// TokenCredential acquires Azure AD access tokens for a resource, like
+// https://vault.azure.net.
+type TokenCredential interface {
+	Token(ctx context.Context, resource string) (string, error)
+}
+
+// credentialProvider is a tokenProvider using a TokenCredential.
+type credentialProvider struct {
+	TokenCredential
+}
+
+func (c credentialProvider) token(ctx context.Context, resource string) (accessToken, error) {
+	t, err := c.Token(ctx, resource)
+	return accessToken{value: t}, err
+}
+
+// errTokenProviderNotAvailable is returned by a tokenProvider that is not
+// configured in this environment, so the next one should be tried.
+var errTokenProviderNotAvailable = errors.New("not available")
+
+// notAvailable returns errTokenProviderNotAvailable with what the
+// provider needs to be available.
+func notAvailable(reason string) error {
+	return fmt.Errorf("%w, %s", errTokenProviderNotAvailable, reason)
+}
+
+// credentialError reports why each credential of the chain could not get
+// a token.
+type credentialError []error
+
+func (e credentialError) Error() string {
+	var b strings.Builder
+	b.WriteString("no Azure credential could get a token, run az login or configure a credential as in https://github.com/sensyn-robotics/vaultenv#usage:")
+	for _, err := range e {
+		fmt.Fprintf(&b, "\n\t* %v", err)
+	}
+	return b.String()
+}
+
+// newCredential returns the chain of token providers used to access
+// Azure. The first provider that is available wins:
+//
+//  1. service principal with a client secret (VAULTENV_AZURE_PASSWORD or
+//     VAULTENV_AZURE_PASSWORD_FILE)
+//  2. service principal with a certificate (VAULTENV_AZURE_CERT_PATH)
+//  3. workload identity federation (AZURE_FEDERATED_TOKEN_FILE)
+//  4. user-assigned managed identity (VAULTENV_AZURE_CLIENT_ID)
+//  5. system-assigned managed identity
+//  6. the account logged in with the Azure CLI (az login)
+//
+// A provider that is configured but fails is reported, and the next one
+// is tried. When none gets a token, the error tells why for each one.
+// Service principals authenticate against the authority of cloud.
+func newCredential(client HTTPClient, cloud azureCloud, logger *log.Logger) tokenProvider {
+	return &chainTokenProvider{
+		providers: []tokenProvider{
+			&clientSecretTokenProvider{
+				client:       client,
+				cloud:        cloud,
+				tenant:       os.Getenv("VAULTENV_AZURE_TENANT"),
+				clientID:     os.Getenv("VAULTENV_AZURE_USER"),
+				clientSecret: os.Getenv("VAULTENV_AZURE_PASSWORD"),
+				secretFile:   os.Getenv("VAULTENV_AZURE_PASSWORD_FILE"),
+			},
+			&certificateTokenProvider{
+				client:   client,
+				cloud:    cloud,
+				tenant:   os.Getenv("VAULTENV_AZURE_TENANT"),
+				clientID: os.Getenv("VAULTENV_AZURE_USER"),
+				path:     os.Getenv("VAULTENV_AZURE_CERT_PATH"),
+				password: os.Getenv("VAULTENV_AZURE_CERT_PASSWORD"),
+			},
+			&workloadIdentityTokenProvider{
+				client:    client,
+				cloud:     cloud,
+				tenant:    os.Getenv("AZURE_TENANT_ID"),
+				clientID:  os.Getenv("AZURE_CLIENT_ID"),
+				tokenFile: os.Getenv("AZURE_FEDERATED_TOKEN_FILE"),
+			},
+			&managedIdentityTokenProvider{
+				client:   client,
+				clientID: os.Getenv("VAULTENV_AZURE_CLIENT_ID"),
+				explicit: true,
+			},
+			&managedIdentityTokenProvider{client: client},
+			&azureCliTokenProvider{
+				subscription: os.Getenv("VAULTENV_AZURE_SUBSCRIPTION"),
+				tenant:       os.Getenv("VAULTENV_AZURE_TENANT"),
+			},
+		},
+		logger: logger,
+		tokens: map[string]accessToken{},
+	}
+}
+
+// authNames are the names of the credentials in Options.AuthOrder and
+// VAULTENV_AUTH_ORDER, in the default order.
+var authNames = []string{"clientsecret", "certificate", "workload", "managed", "cli", "devicecode"}
+
+// authName returns the name of the credential p in authNames.
+// Both the user-assigned and the system managed identities are managed.
+func authName(p tokenProvider) string {
+	switch p.(type) {
+	case *clientSecretTokenProvider:
+		return "clientsecret"
+	case *certificateTokenProvider:
+		return "certificate"
+	case *workloadIdentityTokenProvider:
+		return "workload"
+	case *managedIdentityTokenProvider:
+		return "managed"
+	case *azureCliTokenProvider:
+		return "cli"
+	case *deviceCodeTokenProvider:
+		return "devicecode"
+	}
+	return ""
+}
+
+// orderProviders returns the providers named by names, of authNames, in
+// their order. The others are left out.
+func orderProviders(providers []tokenProvider, names []string) ([]tokenProvider, error) {
+	var ordered []tokenProvider
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		known := false
+		for _, n := range authNames {
+			known = known || n == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown credential %q, must be one of %s", name, strings.Join(authNames, ", "))
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		for _, p := range providers {
+			if authName(p) == name {
+				ordered = append(ordered, p)
+			}
+		}
+	}
+	return ordered, nil
+}
+
+// chainTokenProvider tries its providers in order until one is available
+// and caches the tokens per resource.
+type chainTokenProvider struct {
+	providers []tokenProvider
+	logger    *log.Logger
+
+	// cache stores the tokens between runs when not nil.
+	cache *tokenCache
+
+	mu     sync.Mutex
+	tokens map[string]accessToken
+}
+
+func (c *chainTokenProvider) token(ctx context.Context, resource string) (accessToken, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t, ok := c.tokens[resource]; ok && t.valid() {
+		return t, nil
+	}
+	var errs credentialError
+	for _, p := range c.providers {
+		key := cacheKey(p, resource)
+		if t, ok := c.cache.get(key); ok {
+			c.logger.Printf("using cached token of credential %v for %s", p, resource)
+			t.provider = fmt.Sprint(p)
+			c.tokens[resource] = t
+			return t, nil
+		}
+		t, err := p.token(ctx, resource)
+		if errors.Is(err, errTokenProviderNotAvailable) {
+			c.logger.Printf("credential %v is %v", p, err)
+			errs = append(errs, fmt.Errorf("%v: %v", p, err))
+			continue
+		}
+		if err != nil {
+			c.logger.Printf("credential %v failed: %v", p, err)
+			errs = append(errs, fmt.Errorf("%v: %v", p, err))
+			continue
+		}
+		c.logger.Printf("using credential %v for %s", p, resource)
+		t.provider = fmt.Sprint(p)
+		c.tokens[resource] = t
+		if err := c.cache.put(key, t); err != nil {
+			c.logger.Printf("failed to cache the token: %v", err)
+		}
+		return t, nil
+	}
+	return accessToken{}, errs
+}
+
+// clientSecretTokenProvider authenticates a service principal with a
+// client secret.
+type clientSecretTokenProvider struct {
+	client       HTTPClient
+	cloud        azureCloud
+	tenant       string
+	clientID     string
+	clientSecret string
+	// secretFile is the file of the client secret, like a Docker secret,
+	// read when clientSecret is empty.
+	secretFile string
+}
+
+func (p *clientSecretTokenProvider) String() string {
+	return "client secret"
+}
+
+func (p *clientSecretTokenProvider) cacheKey() string {
+	if p.clientID == "" || (p.clientSecret == "" && p.secretFile == "") {
+		return ""
+	}
+	return p.cloud.authority + "/" + p.tenant + "/" + p.clientID
+}
+
+func (p *clientSecretTokenProvider) token(ctx context.Context, resource string) (accessToken, error) {
+	if p.clientID == "" || (p.clientSecret == "" && p.secretFile == "") {
+		return accessToken{}, notAvailable("set VAULTENV_AZURE_USER, VAULTENV_AZURE_TENANT and VAULTENV_AZURE_PASSWORD or VAULTENV_AZURE_PASSWORD_FILE")
+	}
+	secret, err := p.secret()
+	if err != nil {
+		return accessToken{}, err
+	}
+	values := url.Values{}
+	values.Set("grant_type", "client_credentials")
+	values.Add("client_id", p.clientID)
+	values.Add("client_secret", secret)
+	values.Add("resource", resource)
+	req, err := http.NewRequest("POST", p.cloud.tokenEndpoint(p.tenant), strings.NewReader(values.Encode()))
+	if err != nil {
+		return accessToken{}, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	return requestToken(ctx, p.client, req)
+}
+
+// secret returns the client secret, read from secretFile without its
+// trailing newline when set. Both must agree when both are set.
+func (p *clientSecretTokenProvider) secret() (string, error) {
+	if p.secretFile == "" {
+		return p.clientSecret, nil
+	}
+	b, err := ioutil.ReadFile(p.secretFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the client secret: %v", err)
+	}
+	secret := strings.TrimRight(string(b), "\r\n")
+	if p.clientSecret != "" && p.clientSecret != secret {
+		return "", errors.New("VAULTENV_AZURE_PASSWORD and VAULTENV_AZURE_PASSWORD_FILE are inconsistent, set only one")
+	}
+	return secret, nil
+}
+
+// workloadIdentityTokenProvider authenticates an application with a
+// federated token file, as projected by Kubernetes workload identity or
+// written for GitHub Actions OIDC.
+type workloadIdentityTokenProvider struct {
+	client    HTTPClient
+	cloud     azureCloud
+	tenant    string
+	clientID  string
+	tokenFile string
+}
+
+func (p *workloadIdentityTokenProvider) String() string {
+	return "workload identity"
+}
+
+func (p *workloadIdentityTokenProvider) available() bool {
+	return p.tenant != "" && p.clientID != "" && p.tokenFile != ""
+}
+
+func (p *workloadIdentityTokenProvider) cacheKey() string {
+	if !p.available() {
+		return ""
+	}
+	return p.cloud.authority + "/" + p.tenant + "/" + p.clientID + "/workload-identity"
+}
+
+func (p *workloadIdentityTokenProvider) token(ctx context.Context, resource string) (accessToken, error) {
+	if !p.available() {
+		return accessToken{}, notAvailable("set AZURE_CLIENT_ID, AZURE_TENANT_ID and AZURE_FEDERATED_TOKEN_FILE")
+	}
+	// the file is read every time, as the token in it is rotated.
+	assertion, err := ioutil.ReadFile(p.tokenFile)
+	if err != nil {
+		return accessToken{}, err
+	}
+	values := url.Values{}
+	values.Set("grant_type", "client_credentials")
+	values.Add("client_id", p.clientID)
+	values.Add("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+	values.Add("client_assertion", strings.TrimSpace(string(assertion)))
+	values.Add("scope", strings.TrimSuffix(resource, "/")+"/.default")
+	req, err := http.NewRequest("POST", p.cloud.tokenEndpointV2(p.tenant), strings.NewReader(values.Encode()))
+	if err != nil {
+		return accessToken{}, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	return requestToken(ctx, p.client, req)
+}
+
+// managedIdentityTokenProvider gets tokens of the managed identity from
+// the instance metadata service. clientID selects a user-assigned
+// identity, and when explicit is set the provider is only available with
+// a clientID.
+type managedIdentityTokenProvider struct {
+	client   HTTPClient
+	clientID string
+	explicit bool
+	// timeout bounds the request to the identity endpoint when positive,
+	// so that the chain moves on quickly outside of Azure.
+	timeout time.Duration
+}
+
+func (p *managedIdentityTokenProvider) cacheKey() string {
+	if p.explicit && p.clientID == "" {
+		return ""
+	}
+	return "managed-identity/" + p.clientID
+}
+
+func (p *managedIdentityTokenProvider) String() string {
+	if p.explicit {
+		return "user-assigned managed identity"
+	}
+	return "managed identity"
+}
+
+func (p *managedIdentityTokenProvider) token(ctx context.Context, resource string) (accessToken, error) {
+	if p.explicit && p.clientID == "" {
+		return accessToken{}, notAvailable("set VAULTENV_AZURE_CLIENT_ID")
+	}
+	values := url.Values{}
+	values.Set("api-version", "2019-06-04")
+	values.Set("resource", resource)
+	if p.clientID != "" {
+		values.Set("client_id", p.clientID)
+	}
+	req, err := http.NewRequest("GET", "http://169.254.169.254/metadata/identity/oauth2/token?"+values.Encode(), nil)
+	if err != nil {
+		return accessToken{}, err
+	}
+	req.Header.Add("Metadata", "true")
+	if p.timeout <= 0 {
+		return requestToken(ctx, p.client, req)
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	t, err := requestToken(probeCtx, p.client, req)
+	if err != nil && probeCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return accessToken{}, notAvailable(fmt.Sprintf("the identity endpoint did not answer within %v", p.timeout))
+	}
+	return t, err
+}
+
+// requestToken sends req to a token endpoint and returns the access token
+// of the response with its expiry.
+func requestToken(ctx context.Context, client HTTPClient, req *http.Request) (accessToken, error) {
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return accessToken{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		var e struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		json.NewDecoder(res.Body).Decode(&e)
+		msg := res.Status
+		if e.Error != "" {
+			msg += ": " + e.Error
+		}
+		if e.Description != "" {
+			// the AADSTS code and the trace ids, on several lines
+			msg += ": " + strings.Join(strings.Fields(e.Description), " ")
+		}
+		return accessToken{}, errors.New(msg)
+	}
+	var auth struct {
+		Token     string          `json:"access_token"`
+		ExpiresOn json.RawMessage `json:"expires_on"`
+		ExpiresIn json.RawMessage `json:"expires_in"`
+	}
+	decoder := json.NewDecoder(res.Body)
+	if err = decoder.Decode(&auth); err != nil {
+		return accessToken{}, err
+	}
+	t := accessToken{value: auth.Token}
+	if on, err := jsonSeconds(auth.ExpiresOn); err == nil {
+		t.expiresOn = time.Unix(on, 0)
+	} else if in, err := jsonSeconds(auth.ExpiresIn); err == nil {
+		t.expiresOn = time.Now().Add(time.Duration(in) * time.Second)
+	}
+	return t, nil
+}
+
+// jsonSeconds parses a number of seconds given as a JSON number or string.
+func jsonSeconds(raw json.RawMessage) (int64, error) {
+	return strconv.ParseInt(strings.Trim(string(raw), `"`), 10, 64)
+}
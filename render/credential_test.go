@@ -0,0 +1,397 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserAssignedManagedIdentity(t *testing.T) {
+	os.Setenv("VAULTENV_AZURE_CLIENT_ID", "2f4bd2a8-6b6c-4b26-9d37-3b1b1d3a3c2a")
+	defer os.Unsetenv("VAULTENV_AZURE_CLIENT_ID")
+
+	var b bytes.Buffer
+	template := `PASSWORD={{ kv "https://example.vault.azure.net/secrets/pass" }}
+`
+	expected := `PASSWORD=mysecretvalue5
+`
+	r := strings.NewReader(template)
+	if err := filter(context.Background(), newFetcher(&dummyClient{}), r, &b, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != expected {
+		t.Fatalf("got:%s want:%s", b.String(), expected)
+	}
+}
+
+func TestWorkloadIdentity(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"token": "FEDERATED_TOKEN\n"})
+	defer os.RemoveAll(dir)
+	for name, value := range map[string]string{
+		"AZURE_TENANT_ID":            "tenant",
+		"AZURE_CLIENT_ID":            "client",
+		"AZURE_FEDERATED_TOKEN_FILE": filepath.Join(dir, "token"),
+	} {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	var b bytes.Buffer
+	template := `PASSWORD={{ kv "https://example.vault.azure.net/secrets/pass" }}
+`
+	expected := `PASSWORD=mysecretvalue8
+`
+	r := strings.NewReader(template)
+	if err := filter(context.Background(), newFetcher(&dummyClient{}), r, &b, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != expected {
+		t.Fatalf("got:%s want:%s", b.String(), expected)
+	}
+}
+
+func TestManagedIdentityTimeout(t *testing.T) {
+	p := &managedIdentityTokenProvider{client: &hangingClient{}, timeout: 10 * time.Millisecond}
+	_, err := p.token(context.Background(), "https://vault.azure.net")
+	expected := "the identity endpoint did not answer within 10ms"
+	if !errors.Is(err, errTokenProviderNotAvailable) || !strings.Contains(err.Error(), expected) {
+		t.Fatalf("got:%v want:%s", err, expected)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	p.timeout = time.Minute
+	if _, err := p.token(ctx, "https://vault.azure.net"); err != context.DeadlineExceeded {
+		t.Fatalf("got:%v want:%v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestAzureCli(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"az": `#!/bin/sh
+echo '{"accessToken": "TOKEN_WITH_AZURE_CLI", "expires_on": 4102444800, "tokenType": "Bearer"}'
+`,
+		"az-logged-out": `#!/bin/sh
+echo "ERROR: Please run 'az login' to setup account." >&2
+exit 1
+`,
+	})
+	defer os.RemoveAll(dir)
+	os.Chmod(filepath.Join(dir, "az"), 0700)
+	os.Chmod(filepath.Join(dir, "az-logged-out"), 0700)
+
+	p := &azureCliTokenProvider{command: filepath.Join(dir, "az")}
+	tok, err := p.token(context.Background(), "https://vault.azure.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.value != "TOKEN_WITH_AZURE_CLI" || tok.expiresOn.Unix() != 4102444800 {
+		t.Fatalf("got:%v want:TOKEN_WITH_AZURE_CLI expiring on 4102444800", tok)
+	}
+
+	p = &azureCliTokenProvider{command: filepath.Join(dir, "az-logged-out")}
+	if _, err := p.token(context.Background(), "https://vault.azure.net"); err == nil || !strings.Contains(err.Error(), "Please run 'az login'") {
+		t.Fatalf("got:%v want:Please run 'az login'", err)
+	}
+}
+
+func TestAzureCliAccount(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"az": `#!/bin/sh
+echo "$@" > "$(dirname "$0")/args"
+echo '{"accessToken": "TOKEN_WITH_AZURE_CLI", "expires_on": 4102444800}'
+`,
+	})
+	defer os.RemoveAll(dir)
+	os.Chmod(filepath.Join(dir, "az"), 0700)
+	for _, c := range []struct {
+		p        *azureCliTokenProvider
+		expected string
+	}{
+		{&azureCliTokenProvider{}, ""},
+		{&azureCliTokenProvider{tenant: "t1"}, " --tenant t1"},
+		{&azureCliTokenProvider{tenant: "t1", subscription: "s1"}, " --subscription s1"},
+	} {
+		c.p.command = filepath.Join(dir, "az")
+		if _, err := c.p.token(context.Background(), "https://vault.azure.net"); err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+		expected := "account get-access-token --resource https://vault.azure.net --output json" + c.expected + "\n"
+		if string(b) != expected {
+			t.Fatalf("got:%s want:%s", b, expected)
+		}
+	}
+}
+
+func TestAzureCliRetry(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"az-flaky": `#!/bin/sh
+count="$(dirname "$0")/count"
+echo x >> "$count"
+if [ "$(wc -l < "$count")" -lt 2 ]; then
+  echo "ERROR: token refresh in progress" >&2
+  exit 1
+fi
+echo '{"accessToken": "TOKEN_WITH_AZURE_CLI", "expires_on": 4102444800}'
+`,
+		"az-broken": `#!/bin/sh
+echo x >> "$(dirname "$0")/broken"
+echo "ERROR: internal error" >&2
+exit 1
+`,
+		"az-logged-out": `#!/bin/sh
+echo x >> "$(dirname "$0")/logged-out"
+echo "ERROR: Please run 'az login' to setup account." >&2
+exit 1
+`,
+	})
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"az-flaky", "az-broken", "az-logged-out"} {
+		os.Chmod(filepath.Join(dir, name), 0700)
+	}
+	runs := func(name string) int {
+		b, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		return strings.Count(string(b), "x")
+	}
+
+	p := &azureCliTokenProvider{command: filepath.Join(dir, "az-flaky"), retryDelay: time.Millisecond}
+	if tok, err := p.token(context.Background(), "https://vault.azure.net"); err != nil || tok.value != "TOKEN_WITH_AZURE_CLI" {
+		t.Fatalf("got:%v, %v want:TOKEN_WITH_AZURE_CLI after a retry", tok, err)
+	}
+	if runs("count") != 2 {
+		t.Fatalf("got:%d want:2 runs", runs("count"))
+	}
+
+	p = &azureCliTokenProvider{command: filepath.Join(dir, "az-broken"), retryDelay: time.Millisecond}
+	if _, err := p.token(context.Background(), "https://vault.azure.net"); err == nil || errors.Is(err, errTokenProviderNotAvailable) || !strings.Contains(err.Error(), "internal error") {
+		t.Fatalf("got:%v want:az failed", err)
+	}
+	if runs("broken") != azureCliAttempts {
+		t.Fatalf("got:%d want:%d runs", runs("broken"), azureCliAttempts)
+	}
+
+	p = &azureCliTokenProvider{command: filepath.Join(dir, "az-logged-out"), retryDelay: time.Millisecond}
+	if _, err := p.token(context.Background(), "https://vault.azure.net"); err == nil {
+		t.Fatal("got:nil want:az login error")
+	}
+	if runs("logged-out") != 1 {
+		t.Fatalf("got:%d want:no retry when logged out", runs("logged-out"))
+	}
+
+	p = &azureCliTokenProvider{command: filepath.Join(dir, "az-missing")}
+	if _, err := p.token(context.Background(), "https://vault.azure.net"); !errors.Is(err, errTokenProviderNotAvailable) {
+		t.Fatalf("got:%v want:not available", err)
+	}
+}
+
+func TestNoCredential(t *testing.T) {
+	c := &chainTokenProvider{
+		providers: []tokenProvider{
+			&clientSecretTokenProvider{},
+			&managedIdentityTokenProvider{explicit: true},
+			&azureCliTokenProvider{command: "vaultenv-no-such-az"},
+		},
+		logger: log.New(ioutil.Discard, "", 0),
+		tokens: map[string]accessToken{},
+	}
+	_, err := c.token(context.Background(), "https://vault.azure.net")
+	expected := `no Azure credential could get a token, run az login or configure a credential as in https://github.com/sensyn-robotics/vaultenv#usage:
+	* client secret: not available, set VAULTENV_AZURE_USER, VAULTENV_AZURE_TENANT and VAULTENV_AZURE_PASSWORD or VAULTENV_AZURE_PASSWORD_FILE
+	* user-assigned managed identity: not available, set VAULTENV_AZURE_CLIENT_ID
+	* Azure CLI: not available, vaultenv-no-such-az is not found in PATH`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("got:%v want:%s", err, expected)
+	}
+}
+
+// tokenErrorClient answers the token requests with the errors of Azure AD
+// and of the identity endpoint.
+type tokenErrorClient struct{}
+
+func (c *tokenErrorClient) Do(req *http.Request) (*http.Response, error) {
+	status, body := 401, `{"error": "invalid_client", "error_description": "AADSTS7000215: Invalid client secret provided.\r\nTrace ID: 0e8b\r\nCorrelation ID: 5d1c\r\nTimestamp: 2026-10-14 06:00:00Z"}`
+	if req.URL.Host == "169.254.169.254" {
+		status, body = 400, `{"error": "invalid_request", "error_description": "Identity not found"}`
+	}
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}, nil
+}
+
+func TestCredentialErrorDescription(t *testing.T) {
+	c := &chainTokenProvider{
+		providers: []tokenProvider{
+			&clientSecretTokenProvider{client: &tokenErrorClient{}, cloud: azurePublicCloud, tenant: "tenant", clientID: "client", clientSecret: "wrong"},
+			&managedIdentityTokenProvider{client: &tokenErrorClient{}, explicit: true, clientID: "client"},
+		},
+		logger: log.New(ioutil.Discard, "", 0),
+		tokens: map[string]accessToken{},
+	}
+	_, err := c.token(context.Background(), "https://vault.azure.net")
+	expected := `no Azure credential could get a token, run az login or configure a credential as in https://github.com/sensyn-robotics/vaultenv#usage:
+	* client secret: 401 Unauthorized: invalid_client: AADSTS7000215: Invalid client secret provided. Trace ID: 0e8b Correlation ID: 5d1c Timestamp: 2026-10-14 06:00:00Z
+	* user-assigned managed identity: 400 Bad Request: invalid_request: Identity not found`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("got:%v want:%s", err, expected)
+	}
+}
+
+// deviceCodeClient answers the device code flow, with pending polls
+// before the user signs in.
+type deviceCodeClient struct {
+	pending int
+}
+
+func (c *deviceCodeClient) Do(req *http.Request) (*http.Response, error) {
+	body := `{"device_code": "DEVICE_CODE", "user_code": "USERCODE", "interval": 5, "expires_in": 900, "message": "To sign in, enter the code USERCODE"}`
+	if strings.HasSuffix(req.URL.Path, "/token") {
+		if !strings.Contains(readBody(req), "device_code=DEVICE_CODE") {
+			return nil, errors.New("Unexpected request")
+		}
+		body = `{"access_token": "TOKEN_WITH_DEVICE_CODE", "expires_in": 3599}`
+		if c.pending > 0 {
+			c.pending--
+			body = `{"error": "authorization_pending", "error_description": "AADSTS70016: pending"}`
+		}
+	} else if req.URL.String() != "https://login.microsoftonline.com/organizations/oauth2/v2.0/devicecode" {
+		return nil, errors.New("Unexpected request")
+	}
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}, nil
+}
+
+func TestAuthOrder(t *testing.T) {
+	os.Setenv("VAULTENV_AUTH_ORDER", "cli, managed,cli,devicecode")
+	defer os.Unsetenv("VAULTENV_AUTH_ORDER")
+	r, err := New(Options{Client: &dummyClient{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, p := range r.f.azure.cred.(*chainTokenProvider).providers {
+		names = append(names, fmt.Sprint(p))
+	}
+	expected := "Azure CLI, user-assigned managed identity, managed identity, device code"
+	if strings.Join(names, ", ") != expected {
+		t.Fatalf("got:%s want:%s", strings.Join(names, ", "), expected)
+	}
+
+	os.Setenv("VAULTENV_AUTH_ORDER", "cli,msi")
+	_, err = New(Options{Client: &dummyClient{}})
+	if err == nil || !strings.Contains(err.Error(), `VAULTENV_AUTH_ORDER: unknown credential "msi", must be one of clientsecret, certificate, workload, managed, cli, devicecode`) {
+		t.Fatalf("got:%v want:unknown credential error", err)
+	}
+
+	r, err = New(Options{Client: &dummyClient{}, AuthOrder: []string{"clientsecret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if providers := r.f.azure.cred.(*chainTokenProvider).providers; len(providers) != 1 || fmt.Sprint(providers[0]) != "client secret" {
+		t.Fatalf("got:%v want:client secret only", providers)
+	}
+}
+
+func TestDeviceCode(t *testing.T) {
+	var prompt bytes.Buffer
+	c := &deviceCodeClient{pending: 2}
+	p := &deviceCodeTokenProvider{client: c, cloud: azurePublicCloud, clientID: azureCliClientID, prompt: &prompt, interval: time.Millisecond}
+	tok, err := p.token(context.Background(), "https://vault.azure.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.value != "TOKEN_WITH_DEVICE_CODE" || c.pending != 0 {
+		t.Fatalf("got:%v after %d pending polls want:TOKEN_WITH_DEVICE_CODE", tok, 2-c.pending)
+	}
+	if prompt.String() != "To sign in, enter the code USERCODE\n" {
+		t.Fatalf("got:%s want:To sign in, enter the code USERCODE", prompt.String())
+	}
+}
+
+func TestTokenCache(t *testing.T) {
+	dir := writeFiles(t, map[string]string{})
+	defer os.RemoveAll(dir)
+	cache := &tokenCache{path: filepath.Join(dir, "vaultenv", "tokens.json")}
+	c := &dummyClient{}
+	newChain := func() *chainTokenProvider {
+		return &chainTokenProvider{
+			providers: []tokenProvider{
+				&clientSecretTokenProvider{client: c, cloud: azurePublicCloud, tenant: "tenant", clientID: "client", clientSecret: "secret"},
+			},
+			logger: log.New(ioutil.Discard, "", 0),
+			cache:  cache,
+			tokens: map[string]accessToken{},
+		}
+	}
+	for i := 0; i < 2; i++ {
+		tok, err := newChain().token(context.Background(), "https://vault.azure.net")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok.value != "TOKEN_WITH_CLIENT_CREDENTIAL" || tok.expiresOn.Unix() != 4102444800 {
+			t.Fatalf("got:%v want:TOKEN_WITH_CLIENT_CREDENTIAL expiring on 4102444800", tok)
+		}
+	}
+	if len(c.requests) != 1 {
+		t.Fatalf("got:%v want:1 request", c.requests)
+	}
+	info, err := os.Stat(cache.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("got:%v want:0600", info.Mode().Perm())
+	}
+
+	cache.put("expired", accessToken{value: "old", expiresOn: time.Now().Add(time.Minute)})
+	if _, ok := cache.get("expired"); ok {
+		t.Fatalf("a token about to expire must not be used")
+	}
+}
+
+func TestVaultCredentials(t *testing.T) {
+	os.Setenv("VAULTENV_AZURE_VAULT_CREDENTIALS", `[{"vault": "other-*.vault.azure.net", "tenant": "t2", "clientId": "c2", "clientSecret": "s2"}]`)
+	defer os.Unsetenv("VAULTENV_AZURE_VAULT_CREDENTIALS")
+	client := &dummyClient{}
+	r, err := New(Options{Client: client})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rawurl, expected := range map[string]string{
+		"https://Other-Tenant.vault.azure.net/secrets/pass": "mysecretvalue2",
+		"https://example.vault.azure.net/secrets/pass":      "mysecretvalue1",
+	} {
+		if v, err := r.f.fetch(context.Background(), rawurl); err != nil || v != expected {
+			t.Fatalf("got:%s, %v want:%s for %s", v, err, expected, rawurl)
+		}
+	}
+	if !strings.Contains(strings.Join(client.requests, "\n"), "https://login.microsoftonline.com/t2/oauth2/token") {
+		t.Fatalf("got:%v want:a token of tenant t2", client.requests)
+	}
+
+	for config, expected := range map[string]string{
+		`[{"vault": "[", "tenant": "t", "clientId": "c", "clientSecret": "s"}]`: `invalid vault pattern "["`,
+		`[{"vault": "*.vault.azure.net", "tenant": "t"}]`:                       "set tenant, clientId and clientSecret or clientSecretFile",
+		`[{"vault": 1}]`:            "not a JSON array of credentials",
+		"/no/such/credentials.json": "failed to read VAULTENV_AZURE_VAULT_CREDENTIALS",
+	} {
+		os.Setenv("VAULTENV_AZURE_VAULT_CREDENTIALS", config)
+		if _, err := New(Options{Client: &dummyClient{}}); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("got:%v want:%s", err, expected)
+		}
+	}
+}
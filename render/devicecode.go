@@ -0,0 +1,125 @@
+package render
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// azureCliClientID is the public client of the Azure CLI, which can sign
+// in users to Key Vault with a device code.
+const azureCliClientID = "04b07795-8ddb-461a-bbee-02f9e1bf7b46"
+
+// deviceCodeTokenProvider signs in a user interactively with a device
+// code, showing the code to enter in a browser on prompt.
+type deviceCodeTokenProvider struct {
+	client HTTPClient
+	cloud  azureCloud
+	// tenant is the directory to sign in to, any work or school account
+	// when empty.
+	tenant   string
+	clientID string
+	prompt   io.Writer
+	// interval overrides the polling interval of the token endpoint when
+	// positive.
+	interval time.Duration
+}
+
+func (p *deviceCodeTokenProvider) String() string {
+	return "device code"
+}
+
+func (p *deviceCodeTokenProvider) tenantOrDefault() string {
+	if p.tenant == "" {
+		return "organizations"
+	}
+	return p.tenant
+}
+
+func (p *deviceCodeTokenProvider) cacheKey() string {
+	return p.cloud.authority + "/" + p.tenantOrDefault() + "/" + p.clientID + "/device-code"
+}
+
+// deviceCodeResponse is the answer of the device code and token endpoints.
+type deviceCodeResponse struct {
+	DeviceCode  string          `json:"device_code"`
+	Message     string          `json:"message"`
+	Interval    int             `json:"interval"`
+	ExpiresIn   json.RawMessage `json:"expires_in"`
+	AccessToken string          `json:"access_token"`
+	Error       string          `json:"error"`
+	Description string          `json:"error_description"`
+}
+
+func (p *deviceCodeTokenProvider) token(ctx context.Context, resource string) (accessToken, error) {
+	endpoint := p.cloud.tokenEndpointV2(p.tenantOrDefault())
+	values := url.Values{}
+	values.Set("client_id", p.clientID)
+	values.Set("scope", strings.TrimSuffix(resource, "/")+"/.default")
+	code, err := p.post(ctx, strings.TrimSuffix(endpoint, "/token")+"/devicecode", values)
+	if err != nil {
+		return accessToken{}, err
+	}
+	if code.Error != "" {
+		return accessToken{}, fmt.Errorf("device code login failed: %s: %s", code.Error, code.Description)
+	}
+	fmt.Fprintln(p.prompt, code.Message)
+
+	interval := time.Duration(code.Interval) * time.Second
+	if p.interval > 0 {
+		interval = p.interval
+	}
+	values = url.Values{}
+	values.Set("grant_type", "urn:ietf:params:oauth:grant-type:device_code")
+	values.Set("client_id", p.clientID)
+	values.Set("device_code", code.DeviceCode)
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return accessToken{}, ctx.Err()
+		}
+		res, err := p.post(ctx, endpoint, values)
+		if err != nil {
+			return accessToken{}, err
+		}
+		switch res.Error {
+		case "":
+			t := accessToken{value: res.AccessToken}
+			if in, err := jsonSeconds(res.ExpiresIn); err == nil {
+				t.expiresOn = time.Now().Add(time.Duration(in) * time.Second)
+			}
+			return t, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return accessToken{}, fmt.Errorf("device code login failed: %s: %s", res.Error, res.Description)
+		}
+	}
+}
+
+// post sends the form values to endpoint and decodes the JSON answer,
+// which tells errors in its error field.
+func (p *deviceCodeTokenProvider) post(ctx context.Context, endpoint string, values url.Values) (*deviceCodeResponse, error) {
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	res, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var r deviceCodeResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("%s %s - %s", req.Method, endpoint, res.Status)
+	}
+	return &r, nil
+}
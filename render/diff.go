@@ -0,0 +1,73 @@
+package render
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"text/tabwriter"
+)
+
+// Diff compares the rendered .env read from in with the .env existing,
+// like a checked-in one, and writes for every key whether its value is
+// the same, changed, added or removed, never the values. It fails when
+// a key differs. The last definition of a key is compared.
+func (r *Renderer) Diff(in, existing io.Reader, out io.Writer) error {
+	rendered, err := readEnv(in)
+	if err != nil {
+		return fmt.Errorf("rendered: %v", err)
+	}
+	old, err := readEnv(existing)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	keys, differ := 0, 0
+	for _, l := range rendered {
+		keys++
+		v, ok := lastValue(old, l.key)
+		switch {
+		case !ok:
+			differ++
+			fmt.Fprintf(w, "added\t%s\n", l.key)
+		case v != l.value:
+			differ++
+			fmt.Fprintf(w, "changed\t%s\n", l.key)
+		default:
+			fmt.Fprintf(w, "same\t%s\n", l.key)
+		}
+	}
+	for _, l := range old {
+		if _, ok := lastValue(rendered, l.key); !ok {
+			keys++
+			differ++
+			fmt.Fprintf(w, "removed\t%s\n", l.key)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if differ > 0 {
+		return fmt.Errorf("%d of %d keys differ", differ, keys)
+	}
+	return nil
+}
+
+// readEnv reads the KEY=value lines of a .env, keeping the last line of
+// each key.
+func readEnv(in io.Reader) ([]envLine, error) {
+	b, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	return parseEnv(mergeEnv(b))
+}
+
+// lastValue returns the value of key in lines.
+func lastValue(lines []envLine, key string) (string, bool) {
+	for i := len(lines) - 1; i >= 0; i-- {
+		if lines[i].key == key {
+			return lines[i].value, true
+		}
+	}
+	return "", false
+}
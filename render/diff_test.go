@@ -0,0 +1,44 @@
+package render
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	rendered := `USER=foo@example.com
+PASSWORD=newsecret
+TOKEN=token
+`
+	existing := `# checked in
+USER=foo@example.com
+PASSWORD=oldsecret
+OLD=1
+`
+	expected := `same     USER
+changed  PASSWORD
+added    TOKEN
+removed  OLD
+`
+	r, err := New(Options{Client: &dummyClient{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	err = r.Diff(strings.NewReader(rendered), strings.NewReader(existing), &b)
+	if err == nil || err.Error() != "3 of 4 keys differ" {
+		t.Fatalf("got:%v want:3 of 4 keys differ", err)
+	}
+	if b.String() != expected {
+		t.Fatalf("got:%s want:%s", b.String(), expected)
+	}
+	if strings.Contains(b.String(), "secret") {
+		t.Fatalf("values must not be written: %s", b.String())
+	}
+
+	b.Reset()
+	if err := r.Diff(strings.NewReader(rendered), strings.NewReader(rendered), &b); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,555 @@
+package render
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// envLine is a line of a rendered .env: a KEY=value line, whose value may
+// span several lines, or with an empty key a comment, a blank line or any
+// other line.
+type envLine struct {
+	n     int
+	key   string
+	value string
+	// line is the line as rendered.
+	line string
+	// text is the line as written in dotenv format, with the quotes, the
+	// inline comment and the annotation of its template line, when set.
+	text string
+}
+
+// written returns l as written in dotenv format.
+func (l envLine) written() string {
+	if l.text != "" {
+		return l.text
+	}
+	return l.line
+}
+
+// withText sets the text of the lines env of a template line written as
+// b: the lines before the last are written as they are, and the last one
+// takes the rest of b.
+func withText(env []envLine, b []byte) []envLine {
+	text := string(b)
+	for _, l := range env[:len(env)-1] {
+		text = strings.TrimPrefix(text, l.written()+"\n")
+	}
+	env[len(env)-1].text = text
+	return env
+}
+
+// lineEntry returns the rendered line n of a .env.
+func lineEntry(n int, line string) envLine {
+	l := envLine{n: n, line: line}
+	if key, value, ok, err := parseLine(line); ok && err == nil {
+		l.key, l.value = key, value
+	}
+	return l
+}
+
+// invalid reports whether l is neither a KEY=value line, a comment nor a
+// blank line.
+func (l envLine) invalid() bool {
+	if l.key != "" {
+		return false
+	}
+	return strings.ContainsAny(l.line, "\r\n") || (strings.TrimSpace(l.line) != "" && !isComment(l.line))
+}
+
+// envPairs returns the KEY=value lines of env, and an error for a line
+// that is neither a KEY=value line, a comment nor a blank line.
+func envPairs(env []envLine) ([]envLine, error) {
+	var pairs []envLine
+	for _, l := range env {
+		if l.invalid() {
+			return nil, fmt.Errorf("line %d: not a KEY=value line: %q", l.n, l.line)
+		}
+		if l.key != "" {
+			pairs = append(pairs, l)
+		}
+	}
+	return pairs, nil
+}
+
+// entries returns the .env lines rendered to b by the template line n of
+// s. A template line with a = outside of its actions renders a single
+// KEY=value line, whose value may span several lines like a PEM. A line
+// rendered by include or kvAll has their lines, and the output of any
+// other line is split into lines.
+func (s *source) entries(n int, line string, b []byte, opts Options) []envLine {
+	if indexOutsideActions(line, '=', opts.LeftDelim, opts.RightDelim) >= 0 {
+		if i := bytes.IndexByte(b, '='); i >= 0 {
+			key := strings.TrimSpace(stripExport(string(b[:i])))
+			if key == "" || strings.ContainsAny(key, "\r\n") {
+				return []envLine{{n: n, line: string(b)}}
+			}
+			return []envLine{{n: n, key: key, value: string(b[i+1:]), line: string(b)}}
+		}
+	}
+	if env, ok := s.blocks[string(b)]; ok {
+		lines := make([]envLine, len(env))
+		for i, l := range env {
+			l.n = n
+			lines[i] = l
+		}
+		return lines
+	}
+	var lines []envLine
+	for _, l := range splitLines(b) {
+		lines = append(lines, lineEntry(n, l))
+	}
+	if len(lines) == 0 {
+		return []envLine{{n: n}}
+	}
+	return lines
+}
+
+// textEntries returns the lines of a rendered .env.
+func textEntries(rendered []byte) []envLine {
+	var lines []envLine
+	for i, line := range splitLines(rendered) {
+		lines = append(lines, lineEntry(i+1, line))
+	}
+	return lines
+}
+
+// joinLines returns the lines of env as written, with the final newline
+// of rendered.
+func joinLines(env []envLine, rendered []byte) []byte {
+	var b bytes.Buffer
+	for _, l := range env {
+		b.WriteString(l.written() + "\n")
+	}
+	return matchNewline(b.Bytes(), rendered)
+}
+
+// isComment reports whether the first non-space character of line is #.
+func isComment(line string) bool {
+	return strings.HasPrefix(strings.TrimLeft(line, " \t"), "#")
+}
+
+// parseLine splits a KEY=value line. ok is false for blank lines and
+// comments.
+func parseLine(line string) (key, value string, ok bool, err error) {
+	if strings.TrimSpace(line) == "" || isComment(line) {
+		return "", "", false, nil
+	}
+	i := strings.Index(line, "=")
+	if i >= 0 {
+		key = strings.TrimSpace(stripExport(line[:i]))
+	}
+	if key == "" {
+		return "", "", false, fmt.Errorf("not a KEY=value line: %q", line)
+	}
+	return key, line[i+1:], true, nil
+}
+
+// isEnvLine reports whether the template line rendered to b is a
+// KEY=value line: either the template is, with a value that may render to
+// several lines, or it renders to one, like a key or a whole line given by
+// an action.
+func isEnvLine(line string, b []byte) bool {
+	if _, _, ok, err := parseLine(line); ok && err == nil {
+		return true
+	}
+	_, _, ok, err := parseLine(string(b))
+	return ok && err == nil && !bytes.Contains(b, []byte("\n"))
+}
+
+// stripExport removes the export prefix of a KEY=value line.
+func stripExport(line string) string {
+	trimmed := strings.TrimLeft(line, " \t")
+	if !strings.HasPrefix(trimmed, "export ") {
+		return line
+	}
+	return strings.TrimLeft(trimmed[len("export "):], " \t")
+}
+
+// delims returns the action delimiters left and right, those of Go
+// templates when empty.
+func delims(left, right string) (string, string) {
+	if left == "" {
+		left = "{{"
+	}
+	if right == "" {
+		right = "}}"
+	}
+	return left, right
+}
+
+// indexOutsideActions returns the index of the first c of line outside of
+// the template actions, or -1.
+func indexOutsideActions(line string, c byte, left, right string) int {
+	left, right = delims(left, right)
+	for i := 0; i < len(line); i++ {
+		if strings.HasPrefix(line[i:], left) {
+			j := strings.Index(line[i+len(left):], right)
+			if j < 0 {
+				return -1
+			}
+			i += len(left) + j + len(right) - 1
+		} else if line[i] == c {
+			return i
+		}
+	}
+	return -1
+}
+
+// splitInlineComment splits line at an inline comment, a # preceded by
+// white space outside of quotes and template actions, into the template
+// before it and the comment with its leading white space. The comment is
+// empty when line has none. Empty delimiters are those of Go templates.
+func splitInlineComment(line, left, right string) (tmpl, comment string) {
+	if isComment(line) {
+		return line, ""
+	}
+	left, right = delims(left, right)
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch {
+		case strings.HasPrefix(line[i:], left):
+			j := strings.Index(line[i+len(left):], right)
+			if j < 0 {
+				return line, ""
+			}
+			i += len(left) + j + len(right) - 1
+		case quote != 0:
+			if line[i] == '\\' && quote == '"' {
+				i++
+			} else if line[i] == quote {
+				quote = 0
+			}
+		case line[i] == '"' || line[i] == '\'':
+			quote = line[i]
+		case line[i] == '#' && i > 0 && (line[i-1] == ' ' || line[i-1] == '\t'):
+			tmpl = strings.TrimRight(line[:i], " \t")
+			return tmpl, line[len(tmpl):]
+		}
+	}
+	return line, ""
+}
+
+// quoteReplacer escapes a value for double quotes.
+var quoteReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quoteValue wraps the value of the rendered KEY=value line in double
+// quotes.
+func quoteValue(rendered []byte) []byte {
+	i := bytes.IndexByte(rendered, '=')
+	if i < 0 {
+		return rendered
+	}
+	return []byte(string(rendered[:i+1]) + `"` + quoteReplacer.Replace(string(rendered[i+1:])) + `"`)
+}
+
+// isCRLF reports whether the first line of b ends with CRLF.
+func isCRLF(b []byte) bool {
+	i := bytes.IndexByte(b, '\n')
+	return i > 0 && b[i-1] == '\r'
+}
+
+// splitLines splits rendered into lines without their newlines.
+func splitLines(rendered []byte) []string {
+	s := strings.TrimSuffix(string(rendered), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// parseEnv returns the KEY=value lines of a rendered .env.
+func parseEnv(rendered []byte) ([]envLine, error) {
+	var lines []envLine
+	for i, line := range splitLines(rendered) {
+		key, value, ok, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		if ok {
+			lines = append(lines, envLine{n: i + 1, key: key, value: value, line: line})
+		}
+	}
+	return lines, nil
+}
+
+// replaceKey replaces the key of a KEY=value line.
+func replaceKey(line, key, newKey string) string {
+	i := strings.LastIndex(line[:strings.Index(line, "=")], key)
+	return line[:i] + newKey + line[i+len(key):]
+}
+
+// envKey returns the key as written in the output, or false when the
+// line of key is filtered out.
+func (o Options) envKey(key string) (string, bool) {
+	if o.EnvPrefix != "" {
+		if !strings.HasPrefix(key, o.EnvPrefix) {
+			return "", false
+		}
+		if o.StripPrefix {
+			key = strings.TrimPrefix(key, o.EnvPrefix)
+		}
+	}
+	return o.OutputPrefix + key, true
+}
+
+// selectEnv returns the lines kept by opts with their output keys.
+func selectEnv(lines []envLine, opts Options) []envLine {
+	var selected []envLine
+	for _, l := range lines {
+		if key, ok := opts.envKey(l.key); ok {
+			l.key = key
+			selected = append(selected, l)
+		}
+	}
+	return selected
+}
+
+// renderedFile is the output of a template file, named empty for stdin,
+// with its lines as rendered.
+type renderedFile struct {
+	name     string
+	rendered []byte
+	env      []envLine
+}
+
+// position names line n of the file.
+func (r renderedFile) position(n int) string {
+	if r.name == "" {
+		return fmt.Sprintf("line %d", n)
+	}
+	return fmt.Sprintf("%s:%d", r.name, n)
+}
+
+// validKey matches the keys that are shell variable names.
+var validKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// checkKeys returns an error for every output key of files that is not a
+// valid shell variable name.
+func checkKeys(files []renderedFile, opts Options) error {
+	var errs multiError
+	for _, file := range files {
+		for _, l := range file.env {
+			if l.key == "" {
+				continue
+			}
+			if key, ok := opts.envKey(l.key); ok && !validKey.MatchString(key) {
+				errs = append(errs, fmt.Errorf("%s: invalid key %q, must match %s", file.position(l.n), key, validKey))
+			}
+		}
+	}
+	return errs.errorOrNil()
+}
+
+// checkEnv checks the keys of files as opts asks.
+func checkEnv(files []renderedFile, opts Options) error {
+	if opts.NoDuplicates {
+		if err := checkDuplicateFiles(files, opts); err != nil {
+			return err
+		}
+	}
+	if opts.ValidateKeys {
+		return checkKeys(files, opts)
+	}
+	return nil
+}
+
+// checkDuplicateFiles returns an error for every output key defined by
+// more than one KEY=value line of the concatenation of files.
+func checkDuplicateFiles(files []renderedFile, opts Options) error {
+	type position struct {
+		file renderedFile
+		n    int
+	}
+	var errs multiError
+	seen := map[string]position{}
+	for _, file := range files {
+		for _, l := range file.env {
+			if l.key == "" {
+				continue
+			}
+			key, ok := opts.envKey(l.key)
+			if !ok {
+				continue
+			}
+			if p, dup := seen[key]; dup {
+				switch {
+				case p.file.name != file.name:
+					errs = append(errs, fmt.Errorf("duplicate key %q on %s and %s", key, p.file.position(p.n), file.position(l.n)))
+				case file.name == "":
+					errs = append(errs, fmt.Errorf("duplicate key %q on lines %d and %d", key, p.n, l.n))
+				default:
+					errs = append(errs, fmt.Errorf("%s: duplicate key %q on lines %d and %d", file.name, key, p.n, l.n))
+				}
+				continue
+			}
+			seen[key] = position{file, l.n}
+		}
+	}
+	return errs.errorOrNil()
+}
+
+// mergeEnv drops the KEY=value lines whose key is defined again by a
+// later line, so that later definitions override earlier ones. It reads
+// rendered line by line, like a .env file; a rendered .env whose entries
+// are known is merged with mergeEntries.
+func mergeEnv(rendered []byte) []byte {
+	return joinLines(mergeEntries(textEntries(rendered)), rendered)
+}
+
+// mergeEntries is mergeEnv for the lines env.
+func mergeEntries(env []envLine) []envLine {
+	last := map[string]int{}
+	for i, l := range env {
+		if l.key != "" {
+			last[l.key] = i
+		}
+	}
+	var merged []envLine
+	for i, l := range env {
+		if l.key != "" && last[l.key] != i {
+			continue
+		}
+		merged = append(merged, l)
+	}
+	return merged
+}
+
+// mergeProcessEnv returns the rendered KEY=value line with an empty value
+// replaced by the value of the environment variable KEY, if it is set.
+func mergeProcessEnv(rendered []byte) []byte {
+	key, value, ok, err := parseLine(string(rendered))
+	if !ok || err != nil || value != "" {
+		return rendered
+	}
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return rendered
+	}
+	return append(rendered, v...)
+}
+
+// sortEnv sorts the KEY=value lines of rendered by key, stable for the
+// keys defined more than once. The comments and blank lines before a
+// KEY=value line move with it, and those after the last one stay last.
+func sortEnv(rendered []byte) []byte {
+	return joinLines(sortEntries(textEntries(rendered)), rendered)
+}
+
+// sortEntries is sortEnv for the lines env.
+func sortEntries(env []envLine) []envLine {
+	type group struct {
+		key   string
+		lines []envLine
+	}
+	var groups []group
+	var pending []envLine
+	for _, l := range env {
+		pending = append(pending, l)
+		if l.key != "" {
+			groups = append(groups, group{l.key, pending})
+			pending = nil
+		}
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].key < groups[j].key
+	})
+	var sorted []envLine
+	for _, g := range append(groups, group{lines: pending}) {
+		sorted = append(sorted, g.lines...)
+	}
+	return sorted
+}
+
+// matchNewline removes the final newline of b when rendered has none.
+func matchNewline(b, rendered []byte) []byte {
+	if !bytes.HasSuffix(rendered, []byte("\n")) {
+		return bytes.TrimSuffix(b, []byte("\n"))
+	}
+	return b
+}
+
+// writeDotenv writes the rendered .env, whose lines as rendered are env,
+// rewritten as opts asks. The lines are selected as entries, so that a
+// value spanning several lines is kept or dropped whole.
+func writeDotenv(out io.Writer, env []envLine, rendered []byte, opts Options) error {
+	if !opts.StripExport && opts.EnvPrefix == "" && opts.OutputPrefix == "" {
+		_, err := out.Write(rendered)
+		return err
+	}
+	var b bytes.Buffer
+	for _, l := range env {
+		line := l.written()
+		if l.key == "" {
+			if opts.EnvPrefix == "" {
+				b.WriteString(line + "\n")
+			}
+			continue
+		}
+		key, ok := opts.envKey(l.key)
+		if !ok {
+			continue
+		}
+		if key != l.key {
+			line = replaceKey(line, l.key, key)
+		}
+		if opts.StripExport {
+			line = stripExport(line)
+		}
+		b.WriteString(line + "\n")
+	}
+	_, err := out.Write(matchNewline(b.Bytes(), rendered))
+	return err
+}
+
+// shQuoteReplacer escapes a value for single quotes of the shell.
+var shQuoteReplacer = strings.NewReplacer(`'`, `'\''`)
+
+// writeSh writes the rendered lines env of the .env rendered as shell
+// export statements with single quoted values, to be evaluated by a shell.
+// The newlines of a value stay within its quotes. Blank lines and comments
+// are kept, and any other line or a key that is not a shell variable name
+// is an error.
+func writeSh(out io.Writer, env []envLine, rendered []byte, opts Options) error {
+	var b bytes.Buffer
+	for _, l := range env {
+		if l.invalid() {
+			return fmt.Errorf("line %d: not a KEY=value line: %q", l.n, l.line)
+		}
+		if l.key == "" {
+			if opts.EnvPrefix == "" {
+				b.WriteString(l.line + "\n")
+			}
+			continue
+		}
+		key, ok := opts.envKey(l.key)
+		if !ok {
+			continue
+		}
+		if !validKey.MatchString(key) {
+			return fmt.Errorf("line %d: invalid key %q, must match %s", l.n, key, validKey)
+		}
+		b.WriteString("export " + key + "='" + shQuoteReplacer.Replace(l.value) + "'\n")
+	}
+	_, err := out.Write(matchNewline(b.Bytes(), rendered))
+	return err
+}
+
+// writeJSON writes lines as a JSON object. Later keys override earlier
+// ones.
+func writeJSON(out io.Writer, lines []envLine) error {
+	m := make(map[string]string, len(lines))
+	for _, l := range lines {
+		m[l.key] = l.value
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(m)
+}
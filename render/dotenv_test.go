@@ -0,0 +1,571 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestFormatJSON(t *testing.T) {
+	var b bytes.Buffer
+	template := `# comment
+USER=foo@example.com
+
+PASSWORD={{ kv "https://example.vault.azure.net/secrets/pass" }}
+QUOTED="a\b"
+`
+	expected := `{
+  "PASSWORD": "mysecretvalue1",
+  "QUOTED": "\"a\\b\"",
+  "USER": "foo@example.com"
+}
+`
+	r := strings.NewReader(template)
+	if err := filter(context.Background(), newFetcher(&dummyClient{}), r, &b, Options{Format: "json"}); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != expected {
+		t.Fatalf("got:%s want:%s", b.String(), expected)
+	}
+}
+
+func TestFormatJSONMultiline(t *testing.T) {
+	var b bytes.Buffer
+	template := `KEY={{ kv "https://example.vault.azure.net/secrets/multiline" }}
+LINES={{ kv "https://example.vault.azure.net/secrets/crlf" }}
+`
+	expected := `{
+  "KEY": "-----BEGIN KEY-----\nINJECTED=it's\n-----END KEY-----",
+  "LINES": "line1\nline2\nline3\n"
+}
+`
+	f := newFetcher(&dummyClient{})
+	f.secretNewline = "lf"
+	if err := filter(context.Background(), f, strings.NewReader(template), &b, Options{Format: "json"}); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != expected {
+		t.Fatalf("got:%s want:%s", b.String(), expected)
+	}
+}
+
+func TestFormatJSONInvalidLine(t *testing.T) {
+	var b bytes.Buffer
+	r := strings.NewReader("USER=foo\nnot an env line\n")
+	err := filter(context.Background(), newFetcher(&dummyClient{}), r, &b, Options{Format: "json"})
+	if err == nil || !strings.Contains(err.Error(), "line 2: ") {
+		t.Fatalf("got:%v want:line 2 error", err)
+	}
+}
+
+func TestFormatSh(t *testing.T) {
+	var b bytes.Buffer
+	template := `# comment
+export USER=foo@example.com
+
+PASSWORD={{ kv "https://example.vault.azure.net/secrets/pass" }}
+QUOTED=it's $HOME
+`
+	expected := `# comment
+export USER='foo@example.com'
+
+export PASSWORD='mysecretvalue1'
+export QUOTED='it'\''s $HOME'
+`
+	r := strings.NewReader(template)
+	if err := filter(context.Background(), newFetcher(&dummyClient{}), r, &b, Options{Format: "sh", Quote: true}); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != expected {
+		t.Fatalf("got:%s want:%s", b.String(), expected)
+	}
+
+	err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader("USER=foo\nnot an env line\n"), &b, Options{Format: "sh"})
+	if err == nil || !strings.Contains(err.Error(), "line 2: ") {
+		t.Fatalf("got:%v want:line 2 error", err)
+	}
+}
+
+func TestFormatShMultiline(t *testing.T) {
+	os.Setenv("VAULTENV_TEST_VALUE", "x\n$(echo pwned >&2)=y")
+	defer os.Unsetenv("VAULTENV_TEST_VALUE")
+	var b bytes.Buffer
+	template := `KEY={{ kv "https://example.vault.azure.net/secrets/multiline" }}
+VALUE={{ env "VAULTENV_TEST_VALUE" }}
+`
+	expected := `export KEY='-----BEGIN KEY-----
+INJECTED=it'\''s
+-----END KEY-----'
+export VALUE='x
+$(echo pwned >&2)=y'
+`
+	if err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(template), &b, Options{Format: "sh"}); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != expected {
+		t.Fatalf("got:%s want:%s", b.String(), expected)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("sh", "-c", `eval "$1" && printf '%s|%s|%s' "$KEY" "$VALUE" "${INJECTED-unset}"`, "sh", b.String())
+	cmd.Stderr = &stderr
+	got, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "-----BEGIN KEY-----\nINJECTED=it's\n-----END KEY-----|x\n$(echo pwned >&2)=y|unset" || stderr.Len() > 0 {
+		t.Fatalf("got:%q stderr:%q", got, stderr.String())
+	}
+}
+
+func TestFormatShInvalidKey(t *testing.T) {
+	defer os.Unsetenv("VAULTENV_TEST_KEY")
+	for _, key := range []string{"x\n$(echo pwned >&2)", "$(echo pwned >&2)", "MY-KEY"} {
+		os.Setenv("VAULTENV_TEST_KEY", key)
+		var b bytes.Buffer
+		err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(`{{ env "VAULTENV_TEST_KEY" }}=y`), &b, Options{Format: "sh"})
+		if err == nil || b.Len() > 0 {
+			t.Fatalf("%q: got:%v %q want:error", key, err, b.String())
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	template := `export USER=foo@example.com
+  export PASSWORD={{ kv "https://example.vault.azure.net/secrets/pass" }}
+# export COMMENT=1
+`
+	for _, c := range []struct {
+		opts     Options
+		expected string
+	}{
+		{Options{}, `export USER=foo@example.com
+  export PASSWORD=mysecretvalue1
+# export COMMENT=1
+`},
+		{Options{StripExport: true}, `USER=foo@example.com
+PASSWORD=mysecretvalue1
+# export COMMENT=1
+`},
+		{Options{Format: "json"}, `{
+  "PASSWORD": "mysecretvalue1",
+  "USER": "foo@example.com"
+}
+`},
+	} {
+		var b bytes.Buffer
+		if err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(template), &b, c.opts); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != c.expected {
+			t.Fatalf("got:%s want:%s", b.String(), c.expected)
+		}
+	}
+}
+
+func TestEnvPrefix(t *testing.T) {
+	template := `# service a
+SVCA_USER=foo@example.com
+export SVCA_PASSWORD={{ kv "https://example.vault.azure.net/secrets/pass" }}
+
+# service b
+SVCB_USER=bar@example.com
+`
+	for _, c := range []struct {
+		opts     Options
+		expected string
+	}{
+		{Options{EnvPrefix: "SVCA_"}, `SVCA_USER=foo@example.com
+export SVCA_PASSWORD=mysecretvalue1
+`},
+		{Options{EnvPrefix: "SVCA_", StripPrefix: true}, `USER=foo@example.com
+export PASSWORD=mysecretvalue1
+`},
+		{Options{OutputPrefix: "APP_"}, `# service a
+APP_SVCA_USER=foo@example.com
+export APP_SVCA_PASSWORD=mysecretvalue1
+
+# service b
+APP_SVCB_USER=bar@example.com
+`},
+		{Options{EnvPrefix: "SVCA_", StripPrefix: true, OutputPrefix: "APP_"}, `APP_USER=foo@example.com
+export APP_PASSWORD=mysecretvalue1
+`},
+		{Options{EnvPrefix: "SVCA_", StripPrefix: true, Format: "json"}, `{
+  "PASSWORD": "mysecretvalue1",
+  "USER": "foo@example.com"
+}
+`},
+	} {
+		var b bytes.Buffer
+		if err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(template), &b, c.opts); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != c.expected {
+			t.Fatalf("got:%s want:%s", b.String(), c.expected)
+		}
+	}
+}
+
+func TestEnvPrefixMultiline(t *testing.T) {
+	template := `SVCA_KEY={{ kv "https://example.vault.azure.net/secrets/multiline" }}
+SVCB_KEY={{ kv "https://example.vault.azure.net/secrets/multiline" }}
+SVCA_USER=foo@example.com
+`
+	for _, c := range []struct {
+		opts     Options
+		expected string
+	}{
+		{Options{EnvPrefix: "SVCA_"}, `SVCA_KEY=-----BEGIN KEY-----
+INJECTED=it's
+-----END KEY-----
+SVCA_USER=foo@example.com
+`},
+		{Options{EnvPrefix: "SVCA_", StripPrefix: true, Quote: true}, `KEY="-----BEGIN KEY-----\nINJECTED=it's\n-----END KEY-----"
+USER="foo@example.com"
+`},
+	} {
+		var b bytes.Buffer
+		if err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(template), &b, c.opts); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != c.expected {
+			t.Fatalf("got:%s want:%s", b.String(), c.expected)
+		}
+	}
+}
+
+func TestNoDuplicates(t *testing.T) {
+	template := `USER=foo@example.com
+PASSWORD={{ kv "https://example.vault.azure.net/secrets/pass" }}
+# PASSWORD=commented out
+export PASSWORD=copied
+`
+	var b bytes.Buffer
+	err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(template), &b, Options{NoDuplicates: true})
+	if err == nil || !strings.Contains(err.Error(), `duplicate key "PASSWORD" on lines 2 and 4`) {
+		t.Fatalf("got:%v want:duplicate key error", err)
+	}
+	if b.Len() != 0 {
+		t.Fatalf("got:%s want:no output", b.String())
+	}
+
+	b.Reset()
+	if err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader("USER=foo\nPASSWORD=bar\n"), &b, Options{NoDuplicates: true}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSortKeys(t *testing.T) {
+	var b bytes.Buffer
+	template := `# the user
+USER=foo
+PASSWORD={{ kv "https://example.vault.azure.net/secrets/pass" }}
+
+# the port
+export PORT=8080
+AUTH=first
+AUTH=second
+# trailing comment
+`
+	expected := `AUTH=first
+AUTH=second
+PASSWORD=mysecretvalue1
+
+# the port
+export PORT=8080
+# the user
+USER=foo
+# trailing comment
+`
+	r := strings.NewReader(template)
+	if err := filter(context.Background(), newFetcher(&dummyClient{}), r, &b, Options{SortKeys: true}); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != expected {
+		t.Fatalf("got:%s want:%s", b.String(), expected)
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	os.Setenv("VAULTENV_TEST_HOST", "localhost")
+	os.Setenv("VAULTENV_TEST_PASSWORD", "local password")
+	os.Setenv("VAULTENV_TEST_EMPTY", "from env")
+	defer os.Unsetenv("VAULTENV_TEST_HOST")
+	defer os.Unsetenv("VAULTENV_TEST_PASSWORD")
+	defer os.Unsetenv("VAULTENV_TEST_EMPTY")
+	template := `VAULTENV_TEST_HOST=
+export VAULTENV_TEST_PASSWORD={{ kv "https://example.vault.azure.net/secrets/pass" }}
+VAULTENV_TEST_EMPTY={{ kv "https://example.vault.azure.net/secrets/empty" }}
+VAULTENV_TEST_UNSET=
+# VAULTENV_TEST_HOST=
+`
+	expected := `VAULTENV_TEST_HOST="localhost"
+export VAULTENV_TEST_PASSWORD="mysecretvalue1"
+VAULTENV_TEST_EMPTY="from env"
+VAULTENV_TEST_UNSET=""
+# VAULTENV_TEST_HOST=
+`
+	var b bytes.Buffer
+	if err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(template), &b, Options{MergeEnv: true, Quote: true}); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != expected {
+		t.Fatalf("got:%s want:%s", b.String(), expected)
+	}
+	if _, err := New(Options{MergeEnv: true, WholeFile: true}); err == nil {
+		t.Fatal("got:nil want:error in whole file mode")
+	}
+}
+
+func TestValidateKeys(t *testing.T) {
+	template := `# MY-COMMENT=1
+USER=foo
+_PRIVATE2=1
+MY-KEY={{ kv "https://example.vault.azure.net/secrets/pass" }}
+123KEY=1
+`
+	var b bytes.Buffer
+	if err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(template), &b, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(template), &b, Options{ValidateKeys: true})
+	expected := `2 errors occurred:
+	* line 4: invalid key "MY-KEY", must match ^[A-Za-z_][A-Za-z0-9_]*$
+	* line 5: invalid key "123KEY", must match ^[A-Za-z_][A-Za-z0-9_]*$`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("got:%v want:%s", err, expected)
+	}
+	if err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader("KEY=1\n"), &b, Options{ValidateKeys: true, OutputPrefix: "APP-"}); err == nil {
+		t.Fatal("got:nil want:invalid output key")
+	}
+}
+
+func TestQuote(t *testing.T) {
+	template := `# comment with "quotes"
+USER=foo bar # not a comment
+PASSWORD={{ "a\\b\"c\nd" }}
+
+JSON={{ kv "https://example.vault.azure.net/secrets/json" }}
+`
+	expected := `# comment with "quotes"
+USER="foo bar # not a comment"
+PASSWORD="a\\b\"c\nd"
+
+JSON="{\"username\": \"u\", \"password\": \"p\", \"port\": 5432}"
+`
+	var b bytes.Buffer
+	if err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(template), &b, Options{Quote: true}); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != expected {
+		t.Fatalf("got:%s want:%s", b.String(), expected)
+	}
+}
+
+func TestTrailingNewline(t *testing.T) {
+	for _, c := range []struct {
+		template string
+		opts     Options
+		expected string
+	}{
+		{"TOKEN={{ kv \"https://example.vault.azure.net/secrets/pass\" }}\n", Options{}, "TOKEN=mysecretvalue1\n"},
+		{"TOKEN={{ kv \"https://example.vault.azure.net/secrets/pass\" }}", Options{}, "TOKEN=mysecretvalue1"},
+		{"A=1\r\nB=2\r\n", Options{}, "A=1\r\nB=2\r\n"},
+		{"export A=1\n# c", Options{StripExport: true}, "A=1\n# c"},
+		{"{{ kv \"https://example.vault.azure.net/secrets/pass\" }}\n", Options{NoTrailingNewline: true}, "mysecretvalue1"},
+		{"A=1\n", Options{Format: "json", NoTrailingNewline: true}, "{\n  \"A\": \"1\"\n}"},
+		{"", Options{}, ""},
+	} {
+		var b bytes.Buffer
+		if err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(c.template), &b, c.opts); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != c.expected {
+			t.Fatalf("got:%q want:%q", b.String(), c.expected)
+		}
+	}
+}
+
+func TestValueOnly(t *testing.T) {
+	opts := Options{ValueOnly: true}
+	for template, expected := range map[string]string{
+		"{{ kv \"https://example.vault.azure.net/secrets/pass\" }}\n": "mysecretvalue1",
+		"{{ kv \"https://example.vault.azure.net/secrets/pass\" }}":   "mysecretvalue1",
+		"": "",
+	} {
+		var b bytes.Buffer
+		if err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(template), &b, opts); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != expected {
+			t.Fatalf("got:%q want:%q", b.String(), expected)
+		}
+	}
+
+	var b bytes.Buffer
+	err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader("A=1\nB=2\n"), &b, opts)
+	if err == nil || !strings.Contains(err.Error(), "single line template") {
+		t.Fatalf("got:%v want:single line template", err)
+	}
+}
+
+func TestCRLF(t *testing.T) {
+	template := "# comment\r\nexport TOKEN={{ kv \"https://example.vault.azure.net/secrets/pass\" }}\r\nUSER=foo\r\n"
+	for _, c := range []struct {
+		opts     Options
+		expected string
+	}{
+		{Options{}, "# comment\r\nexport TOKEN=mysecretvalue1\r\nUSER=foo\r\n"},
+		{Options{StripExport: true, NoTrailingNewline: true}, "# comment\r\nTOKEN=mysecretvalue1\r\nUSER=foo"},
+		{Options{WholeFile: true}, "# comment\r\nexport TOKEN=mysecretvalue1\r\nUSER=foo\r\n"},
+		{Options{Format: "json"}, "{\n  \"TOKEN\": \"mysecretvalue1\",\n  \"USER\": \"foo\"\n}\n"},
+	} {
+		var b bytes.Buffer
+		if err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(template), &b, c.opts); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != c.expected {
+			t.Fatalf("got:%q want:%q", b.String(), c.expected)
+		}
+	}
+}
+
+func TestLongLine(t *testing.T) {
+	value := strings.Repeat("a", 100*1024)
+	template := "CERT=" + value + "{{ kv \"https://example.vault.azure.net/secrets/pass\" }}\n"
+	expected := "CERT=" + value + "mysecretvalue1\n"
+	var b bytes.Buffer
+	if err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(template), &b, Options{MaxLineBytes: 4 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != expected {
+		t.Fatalf("got:%d bytes want:%d bytes", b.Len(), len(expected))
+	}
+
+	err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(template), &b, Options{MaxLineBytes: 64 * 1024})
+	if err == nil || !strings.Contains(err.Error(), "line 1: longer than 65536 bytes") {
+		t.Fatalf("got:%v want:line 1: longer than 65536 bytes", err)
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	var b bytes.Buffer
+	template := `PASSWORD={{ kv "https://example.vault.azure.net/secrets/pass" }}
+USER=foo@example.com
+`
+	expected := `PASSWORD=mysecretvalue1 # version=4387e9f3d6e14c459867679a90fd0f79
+USER=foo@example.com
+`
+	if err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(template), &b, Options{Annotate: true}); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != expected {
+		t.Fatalf("got:%s want:%s", b.String(), expected)
+	}
+}
+
+func TestInlineComments(t *testing.T) {
+	template := `PORT=8080 # the app port
+PASSWORD={{ kv "https://example.vault.azure.net/secrets/pass" }} # {{ kv "https://example.vault.azure.net/secrets/forbidden" }}
+QUOTED="a # b" # c
+SINGLE='a # b'
+HASH=a#b
+ACTION={{ "x # y" }}	# tab
+`
+	for _, c := range []struct {
+		opts     Options
+		expected string
+	}{
+		{Options{InlineComments: true}, `PORT=8080 # the app port
+PASSWORD=mysecretvalue1 # {{ kv "https://example.vault.azure.net/secrets/forbidden" }}
+QUOTED="a # b" # c
+SINGLE='a # b'
+HASH=a#b
+ACTION=x # y	# tab
+`},
+		{Options{InlineComments: true, Format: "json"}, `{
+  "ACTION": "x # y",
+  "HASH": "a#b",
+  "PASSWORD": "mysecretvalue1",
+  "PORT": "8080",
+  "QUOTED": "\"a # b\"",
+  "SINGLE": "'a # b'"
+}
+`},
+	} {
+		var b bytes.Buffer
+		client := &dummyClient{}
+		if err := filter(context.Background(), newFetcher(client), strings.NewReader(template), &b, c.opts); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != c.expected {
+			t.Fatalf("got:%s want:%s", b.String(), c.expected)
+		}
+		for _, req := range client.requests {
+			if strings.Contains(req, "forbidden") {
+				t.Fatalf("got:%s want:no request of a comment", req)
+			}
+		}
+	}
+}
+
+func TestTemplatedKeys(t *testing.T) {
+	os.Setenv("VAULTENV_TEST_PREFIX", "APP")
+	os.Setenv("VAULTENV_TEST_LINE", "APP_PORT=8080")
+	defer os.Unsetenv("VAULTENV_TEST_PREFIX")
+	defer os.Unsetenv("VAULTENV_TEST_LINE")
+	template := `{{ env "VAULTENV_TEST_PREFIX" }}_USER=foo bar
+{{ env "VAULTENV_TEST_PREFIX" }}_PASSWORD={{ kv "https://example.vault.azure.net/secrets/pass" }}
+{{ env "VAULTENV_TEST_LINE" }}
+OTHER=1
+`
+	for _, c := range []struct {
+		opts     Options
+		expected string
+	}{
+		{Options{Quote: true}, `APP_USER="foo bar"
+APP_PASSWORD="mysecretvalue1"
+APP_PORT="8080"
+OTHER="1"
+`},
+		{Options{Format: "json"}, `{
+  "APP_PASSWORD": "mysecretvalue1",
+  "APP_PORT": "8080",
+  "APP_USER": "foo bar",
+  "OTHER": "1"
+}
+`},
+		{Options{Format: "sh"}, `export APP_USER='foo bar'
+export APP_PASSWORD='mysecretvalue1'
+export APP_PORT='8080'
+export OTHER='1'
+`},
+		{Options{EnvPrefix: "APP_", StripPrefix: true, SortKeys: true}, `PASSWORD=mysecretvalue1
+PORT=8080
+USER=foo bar
+`},
+	} {
+		var b bytes.Buffer
+		if err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(template), &b, c.opts); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != c.expected {
+			t.Fatalf("%+v: got:%s want:%s", c.opts, b.String(), c.expected)
+		}
+	}
+
+	os.Setenv("VAULTENV_TEST_PREFIX", "MY-APP")
+	err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(template), ioutil.Discard, Options{ValidateKeys: true})
+	if err == nil || !strings.Contains(err.Error(), `line 1: invalid key "MY-APP_USER"`) {
+		t.Fatalf("got:%v want:invalid key MY-APP_USER", err)
+	}
+	err = filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader("{{ env \"VAULTENV_TEST_PREFIX\" }}_USER=1\nMY-APP_USER=2\n"), ioutil.Discard, Options{NoDuplicates: true})
+	if err == nil || !strings.Contains(err.Error(), `duplicate key "MY-APP_USER" on lines 1 and 2`) {
+		t.Fatalf("got:%v want:duplicate key MY-APP_USER", err)
+	}
+}
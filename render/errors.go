@@ -0,0 +1,81 @@
+package render
+
+import "errors"
+
+// The errors matched with errors.Is by the errors of Render, RenderFiles,
+// Check and Exec, to tell the causes of failures apart. Network failures
+// are the *url.Error of the HTTP client.
+var (
+	// ErrSecretNotFound matches the errors of secrets that do not exist.
+	ErrSecretNotFound = errors.New("secret not found")
+	// ErrUnauthorized matches the errors of secrets that the credential
+	// may not read, and of references no credential could get a token
+	// for.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrTemplateParse matches the errors of templates that do not parse,
+	// like calls of unknown functions.
+	ErrTemplateParse = errors.New("template parse error")
+)
+
+// Is reports whether e is target, ErrSecretNotFound or ErrUnauthorized,
+// from its status and error code.
+func (e *responseError) Is(target error) bool {
+	switch target {
+	case ErrSecretNotFound:
+		return e.statusCode == 404 || e.code == "ResourceNotFoundException"
+	case ErrUnauthorized:
+		return e.statusCode == 401 || e.statusCode == 403 || e.code == "AccessDeniedException"
+	}
+	return false
+}
+
+// Is reports whether target is ErrUnauthorized.
+func (e credentialError) Is(target error) bool {
+	return target == ErrUnauthorized
+}
+
+// Is reports whether any error of m is target.
+func (m multiError) Is(target error) bool {
+	for _, err := range m {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error of m that matches target.
+func (m multiError) As(target interface{}) bool {
+	for _, err := range m {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseError is the error of a template that does not parse, matching
+// ErrTemplateParse.
+type parseError struct {
+	err error
+}
+
+func (e *parseError) Error() string {
+	return e.err.Error()
+}
+
+func (e *parseError) Unwrap() error {
+	return e.err
+}
+
+func (e *parseError) Is(target error) bool {
+	return target == ErrTemplateParse
+}
+
+// parsed returns err of parsing a template as a parseError.
+func parsed(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &parseError{err}
+}
@@ -0,0 +1,87 @@
+package render
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// execCommand runs args with the rendered KEY=value lines added to the
+// environment and returns the exit code of the command. The values are
+// those rendered, even when they span several lines. ctx cancels the
+// rendering, not the command: SIGINT and SIGTERM are forwarded to the
+// command, which decides how to stop, and its exit code is returned.
+func execCommand(ctx context.Context, f *fetcher, in io.Reader, args []string, opts Options) (int, error) {
+	if len(args) == 0 {
+		return 0, errors.New("exec: no command given")
+	}
+	opts.Quote = false
+	opts.Annotate = false
+	// The deadline bounds the rendering, not the command.
+	rctx, cancel := f.withDeadline(ctx)
+	src := &source{}
+	err := renderSource(rctx, f, src, in, ioutil.Discard, opts)
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+	if err := checkEnv([]renderedFile{{env: src.env}}, opts); err != nil {
+		return 0, err
+	}
+	lines, err := envPairs(src.env)
+	if err != nil {
+		return 0, err
+	}
+	env := os.Environ()
+	for _, l := range selectEnv(lines, opts) {
+		env = append(env, l.key+"="+l.value)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case s := <-signals:
+				cmd.Process.Signal(s)
+			case <-done:
+				return
+			}
+		}
+	}()
+	if err := cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitCode(exitErr), nil
+		}
+		return 0, err
+	}
+	return 0, nil
+}
+
+// exitCode returns the exit code of a command, or 128 plus the signal that
+// killed it as a shell does.
+func exitCode(err *exec.ExitError) int {
+	if status, ok := err.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return err.ExitCode()
+}
@@ -0,0 +1,127 @@
+package render
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestExecCommand(t *testing.T) {
+	os.Setenv("VAULTENV_TEST_INHERITED", "inherited")
+	defer os.Unsetenv("VAULTENV_TEST_INHERITED")
+
+	template := `PASSWORD={{ kv "https://example.vault.azure.net/secrets/pass" }}
+# comment
+`
+	r := strings.NewReader(template)
+	script := `[ "$PASSWORD" = mysecretvalue1 ] && [ "$VAULTENV_TEST_INHERITED" = inherited ] && exit 3`
+	code, err := execCommand(context.Background(), newFetcher(&dummyClient{}), r, []string{"sh", "-c", script}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 3 {
+		t.Fatalf("got:%d want:3", code)
+	}
+}
+
+func TestExecCommandMultiline(t *testing.T) {
+	template := `KEY={{ kv "https://example.vault.azure.net/secrets/multiline" }}
+`
+	r := strings.NewReader(template)
+	script := `[ "$KEY" = "$(printf '%s\n%s\n%s' '-----BEGIN KEY-----' "INJECTED=it's" '-----END KEY-----')" ] && [ -z "${INJECTED+set}" ] && exit 3`
+	code, err := execCommand(context.Background(), newFetcher(&dummyClient{}), r, []string{"sh", "-c", script}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 3 {
+		t.Fatalf("got:%d want:3", code)
+	}
+}
+
+func TestExecCommandInlineComments(t *testing.T) {
+	template := `PORT=8080 # the port
+PASSWORD={{ kv "https://example.vault.azure.net/secrets/pass" }} # {{ kv "https://example.vault.azure.net/secrets/missing" }}
+`
+	r := strings.NewReader(template)
+	script := `[ "$PORT" = 8080 ] && [ "$PASSWORD" = mysecretvalue1 ] && exit 3`
+	code, err := execCommand(context.Background(), newFetcher(&dummyClient{}), r, []string{"sh", "-c", script}, Options{InlineComments: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 3 {
+		t.Fatalf("got:%d want:3", code)
+	}
+}
+
+func TestExecCommandInvalidLine(t *testing.T) {
+	r := strings.NewReader("not an env line\n")
+	if _, err := execCommand(context.Background(), newFetcher(&dummyClient{}), r, []string{"true"}, Options{}); err == nil {
+		t.Fatalf("must be error")
+	}
+}
+
+func TestExecCommandCanceled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vaultenv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ran := filepath.Join(dir, "ran")
+
+	r, err := New(Options{Client: &hangingClient{}, Credential: staticCredential("TOKEN"), Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	template := `PASSWORD={{ kv "https://example.vault.azure.net/secrets/pass" }}
+`
+	if _, err := r.Exec(ctx, strings.NewReader(template), []string{"touch", ran}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got:%v want:%v", err, context.Canceled)
+	}
+	if _, err := os.Stat(ran); !os.IsNotExist(err) {
+		t.Fatalf("got:%v want:the command not run", err)
+	}
+}
+
+func TestExecCommandSignal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vaultenv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ready := filepath.Join(dir, "ready")
+
+	go func() {
+		for {
+			if _, err := os.Stat(ready); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		p, _ := os.FindProcess(os.Getpid())
+		p.Signal(syscall.SIGTERM)
+	}()
+	script := `trap 'exit 3' TERM; touch "$0"; while :; do sleep 0.1; done`
+	code, err := execCommand(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(""), []string{"sh", "-c", script, ready}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 3 {
+		t.Fatalf("got:%d want:3, the exit code of the command stopping on SIGTERM", code)
+	}
+
+	code, err = execCommand(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(""), []string{"sh", "-c", "kill -TERM $$"}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 128+int(syscall.SIGTERM) {
+		t.Fatalf("got:%d want:%d", code, 128+int(syscall.SIGTERM))
+	}
+}
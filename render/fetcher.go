@@ -0,0 +1,888 @@
+package render
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backend resolves a secret reference of a particular kind.
+type backend interface {
+	Fetch(ctx context.Context, u *url.URL) (string, error)
+}
+
+// validator is implemented by backends that can check a reference
+// without fetching it.
+type validator interface {
+	Validate(u *url.URL) error
+}
+
+// dryRunValue is returned for every reference in dry-run mode.
+const dryRunValue = "<dry-run>"
+
+// maskValue replaces the secrets in mask mode.
+const maskValue = "******"
+
+// responseError is returned when a backend answers with an error status.
+type responseError struct {
+	method     string
+	url        string
+	status     string
+	statusCode int
+	// code is the backend specific error code, if any.
+	code string
+	// requestID identifies the request for support cases, if any.
+	requestID string
+	// secret is the name of the secret being fetched, if known.
+	secret string
+}
+
+func (e *responseError) Error() string {
+	if e.secret == "" {
+		return fmt.Sprintf("%s %s - %s", e.method, e.url, e.status)
+	}
+	msg := fmt.Sprintf("fetch %q failed: %s", e.secret, e.status)
+	if e.requestID != "" {
+		msg += " (request-id: " + e.requestID + ")"
+	}
+	return msg
+}
+
+// isNotFound reports whether err means that the secret does not exist.
+func isNotFound(err error) bool {
+	return errors.Is(err, ErrSecretNotFound)
+}
+
+// fetcher dispatches kv references to the backend registered for their
+// URL scheme.
+type fetcher struct {
+	backends map[string]backend
+	azure    *azureBackend
+	logger   *log.Logger
+	// dryRun validates references instead of fetching them.
+	dryRun bool
+	// mask hides the fetched values in the output.
+	mask bool
+	// timeout bounds the time spent fetching a secret when positive.
+	timeout time.Duration
+	// deadline bounds the time spent fetching the secrets of a rendering
+	// when positive.
+	deadline time.Duration
+	// transforms are the names of the transformers applied to every
+	// fetched value, after those of its reference.
+	transforms []string
+	// progress receives the counter of the prefetched secrets when not
+	// nil.
+	progress io.Writer
+	// secretNewline is the normalization of the line endings of the
+	// fetched values, lf, strip or empty for none.
+	secretNewline string
+	// noCache fetches every reference, even those already fetched, without
+	// reading or writing store.
+	noCache bool
+	// store holds the secrets fetched by earlier runs, when not nil.
+	store *secretStore
+	// allowMissing renders missing secrets as empty values.
+	allowMissing bool
+	// defaultVault is the Key Vault of references that are secret names,
+	// a vault name or url.
+	defaultVault string
+
+	mu sync.Mutex
+	// secretCache holds the values already fetched in this run, keyed
+	// on the normalized reference URL.
+	secretCache map[string]string
+	// sources maps fetched values back to their references for messages
+	// and redaction.
+	sources map[string]string
+	// properties holds the Key Vault secrets fetched for their
+	// properties, keyed like secretCache.
+	properties map[string]*azureSecret
+	// stats counts the fetches of this run.
+	stats fetchStats
+	// results holds the error of fetching each reference, nil when
+	// fetched, keyed on the reference as written.
+	results map[string]error
+	// report collects the results of the references rendered, when
+	// reporting.
+	report    []refResult
+	reporting bool
+
+	// maxPerVault limits the concurrent fetches from a vault when
+	// positive, with a semaphore per vault in vaultSlots.
+	maxPerVault int
+	vaultSlots  map[string]chan struct{}
+}
+
+// fetchStats counts the secret fetches of a run for its summary.
+type fetchStats struct {
+	fetched   int
+	cacheHits int
+	// vaults holds the vaults secrets were fetched from.
+	vaults map[string]bool
+}
+
+func newFetcher(client HTTPClient) *fetcher {
+	logger := log.New(ioutil.Discard, "vaultenv: ", 0)
+	cloud, _ := azureCloudFromEnv()
+	azure := &azureBackend{
+		client: client,
+		cred:   newCredential(client, cloud, logger),
+		cloud:  cloud,
+		scope:  os.Getenv("VAULTENV_VAULT_SCOPE"),
+		warn:   log.New(os.Stderr, "vaultenv: warning: ", 0),
+		logger: logger,
+	}
+	return &fetcher{
+		backends: map[string]backend{
+			"https": azure,
+			"vault": &hashicorpBackend{client: client},
+			"arn":   &awsBackend{client: client},
+			"gcp":   &gcpBackend{client: client},
+			"appconfig": &appConfigBackend{
+				client: client,
+				azure:  azure,
+			},
+		},
+		azure:       azure,
+		logger:      logger,
+		secretCache: map[string]string{},
+		sources:     map[string]string{},
+		properties:  map[string]*azureSecret{},
+		stats:       fetchStats{vaults: map[string]bool{}},
+		results:     map[string]error{},
+		vaultSlots:  map[string]chan struct{}{},
+	}
+}
+
+// parse parses the reference rawurl. A bare secret name, optionally
+// followed by /<version> and query options, is a secret of the default
+// vault.
+func (f *fetcher) parse(rawurl string) (*url.URL, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Scheme != "" || u.Host != "" || strings.HasPrefix(u.Path, "projects/") {
+		return lowerHost(u), err
+	}
+	if f.defaultVault == "" {
+		return nil, fmt.Errorf("Invalid url - %s: set a default vault with --vault or VAULTENV_DEFAULT_VAULT to use secret names", rawurl)
+	}
+	vault := f.defaultVault
+	if !strings.Contains(vault, "://") {
+		vault = "https://" + vault + "." + f.azure.cloud.vaultSuffix
+	}
+	secret, err := url.Parse(strings.TrimSuffix(vault, "/") + "/secrets/" + u.Path)
+	if err != nil {
+		return nil, err
+	}
+	secret.RawQuery = u.RawQuery
+	return lowerHost(secret), nil
+}
+
+// lowerHost lowercases the host of a Key Vault or App Configuration url
+// u, as host names are case insensitive, so that the references of a
+// vault written in any case are validated and cached as one.
+func lowerHost(u *url.URL) *url.URL {
+	if u != nil && (u.Scheme == "https" || u.Scheme == "appconfig") {
+		u.Host = strings.ToLower(u.Host)
+	}
+	return u
+}
+
+// fetch fetches the reference rawurl and records the result.
+func (f *fetcher) fetch(ctx context.Context, rawurl string) (string, error) {
+	v, err := f.fetchRef(ctx, rawurl)
+	f.mu.Lock()
+	f.results[rawurl] = err
+	f.mu.Unlock()
+	return v, err
+}
+
+func (f *fetcher) fetchRef(ctx context.Context, rawurl string) (string, error) {
+	u, err := f.parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	o, err := parseRefOptions(u)
+	if err != nil {
+		return "", err
+	}
+	scheme := u.Scheme
+	if scheme == "" && strings.HasPrefix(u.Path, "projects/") {
+		scheme = "gcp"
+	}
+	b, ok := f.backends[scheme]
+	if !ok {
+		return "", fmt.Errorf("Invalid url - %s", rawurl)
+	}
+	if f.dryRun {
+		if v, ok := b.(validator); ok {
+			if err := v.Validate(u); err != nil {
+				return "", err
+			}
+		}
+		return dryRunValue, nil
+	}
+	key := u.String()
+	f.mu.Lock()
+	v, ok := f.secretCache[key]
+	f.mu.Unlock()
+	if ok && !f.noCache {
+		f.logger.Printf("cache hit for %s", key)
+		f.mu.Lock()
+		f.stats.cacheHits++
+		f.mu.Unlock()
+		return f.applyOptions(o, rawurl, v)
+	}
+	if !f.noCache {
+		if v, ok := f.store.get(key); ok {
+			f.logger.Printf("cache hit for %s from an earlier run", key)
+			f.mu.Lock()
+			f.secretCache[key] = v
+			f.stats.cacheHits++
+			f.mu.Unlock()
+			return f.applyOptions(o, rawurl, v)
+		}
+	}
+	release, err := f.acquire(ctx, vaultOf(u))
+	if err != nil {
+		if f.deadline > 0 && err == context.DeadlineExceeded {
+			return "", f.notResolved(rawurl)
+		}
+		return "", err
+	}
+	f.logger.Printf("fetching secret %q from %s", secretName(rawurl), u.Host)
+	start := time.Now()
+	err = f.withTimeout(ctx, rawurl, func(ctx context.Context) (err error) {
+		v, err = b.Fetch(ctx, u)
+		return err
+	})
+	release()
+	if err != nil {
+		return "", err
+	}
+	f.logger.Printf("fetched secret %q in %v", secretName(rawurl), time.Since(start))
+	if !f.noCache {
+		if err := f.store.put(key, v); err != nil {
+			f.logger.Printf("failed to cache secret %q: %v", secretName(rawurl), err)
+		}
+	}
+	f.mu.Lock()
+	f.secretCache[key] = v
+	f.stats.fetched++
+	f.stats.vaults[vaultOf(u)] = true
+	f.mu.Unlock()
+	return f.applyOptions(o, rawurl, v)
+}
+
+// acquire waits for a free slot of vault when the fetches per vault are
+// limited, and returns the function releasing it.
+func (f *fetcher) acquire(ctx context.Context, vault string) (func(), error) {
+	if f.maxPerVault <= 0 {
+		return func() {}, nil
+	}
+	f.mu.Lock()
+	slots, ok := f.vaultSlots[vault]
+	if !ok {
+		slots = make(chan struct{}, f.maxPerVault)
+		f.vaultSlots[vault] = slots
+	}
+	f.mu.Unlock()
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// vaultOf returns the vault of the reference u: the host, the project of
+// Google Cloud or the region and account of AWS.
+func vaultOf(u *url.URL) string {
+	if u.Host != "" {
+		return u.Host
+	}
+	if i := strings.Index(u.Opaque, ":secret:"); i >= 0 {
+		return u.Scheme + ":" + u.Opaque[:i]
+	}
+	parts := strings.SplitN(u.Path, "/", 3)
+	return strings.Join(parts[:len(parts)-1], "/")
+}
+
+// summary describes the fetches of the run, without any value.
+func (f *fetcher) summary() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return fmt.Sprintf("%d secrets fetched from %d vaults, %d cache hits", f.stats.fetched, len(f.stats.vaults), f.stats.cacheHits)
+}
+
+// applyOptions returns the value v of rawurl with its line endings
+// normalized, transformed as o asks, then by the transformers of every
+// value, and remembers rawurl as its source.
+func (f *fetcher) applyOptions(o refOptions, rawurl, v string) (string, error) {
+	v, err := o.apply(rawurl, normalizeNewlines(v, f.secretNewline))
+	if err != nil {
+		return "", err
+	}
+	if v, err = transform(f.transforms, rawurl, v); err != nil {
+		return "", err
+	}
+	f.mu.Lock()
+	f.sources[v] = rawurl
+	f.mu.Unlock()
+	return v, nil
+}
+
+// normalizeNewlines rewrites the line endings of v as mode asks: lf
+// turns CRLF and CR into LF, strip removes them all, and empty keeps v.
+func normalizeNewlines(v, mode string) string {
+	switch mode {
+	case "lf":
+		return strings.Replace(strings.Replace(v, "\r\n", "\n", -1), "\r", "\n", -1)
+	case "strip":
+		return strings.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, v)
+	}
+	return v
+}
+
+// refOptions are the transformations of a value given in the query of
+// its reference, like ?encoding=base64&trim=true&transform=urlencode.
+type refOptions struct {
+	base64 bool
+	trim   bool
+	// transforms are the names of the transformers applied after
+	// decoding and trimming.
+	transforms []string
+}
+
+// parseRefOptions parses the query of u and removes it, so that u
+// identifies the secret.
+func parseRefOptions(u *url.URL) (refOptions, error) {
+	var o refOptions
+	if u.RawQuery == "" {
+		return o, nil
+	}
+	var rest url.Values
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return o, fmt.Errorf("Invalid url - %s: %v", u, err)
+	}
+	for key, values := range query {
+		v := values[len(values)-1]
+		switch key {
+		case "encoding":
+			if v != "base64" {
+				return o, fmt.Errorf("Invalid url - %s: unknown encoding %q, must be base64", u, v)
+			}
+			o.base64 = true
+		case "trim":
+			if o.trim, err = strconv.ParseBool(v); err != nil {
+				return o, fmt.Errorf("Invalid url - %s: trim must be true or false", u)
+			}
+		case "transform":
+			for _, v := range values {
+				for _, name := range strings.Split(v, ",") {
+					if _, err := lookupTransformer(name); err != nil {
+						return o, fmt.Errorf("Invalid url - %s: %v", u, err)
+					}
+					o.transforms = append(o.transforms, name)
+				}
+			}
+		case "label":
+			if u.Scheme != "appconfig" {
+				return o, fmt.Errorf("Invalid url - %s: label is an option of App Configuration references only", u)
+			}
+			// The label selects the value, so it stays in the url
+			// for the backend and the cache.
+			rest = url.Values{"label": {v}}
+		default:
+			return o, fmt.Errorf("Invalid url - %s: unknown option %q, must be encoding, trim or transform", u, key)
+		}
+	}
+	u.RawQuery = rest.Encode()
+	return o, nil
+}
+
+// apply decodes, trims, then transforms the value v of rawurl as o asks.
+func (o refOptions) apply(rawurl, v string) (string, error) {
+	if o.base64 {
+		b, err := decodeBase64(v)
+		if err != nil {
+			return "", fmt.Errorf("secret %q is not valid base64: %v", secretName(rawurl), err)
+		}
+		v = b
+	}
+	if o.trim {
+		v = strings.TrimSpace(v)
+	}
+	return transform(o.transforms, rawurl, v)
+}
+
+// version returns the version of the fetched Key Vault secret rawurl.
+func (f *fetcher) version(rawurl string) (string, bool) {
+	u, err := f.parse(rawurl)
+	if err != nil {
+		return "", false
+	}
+	if _, err := parseRefOptions(u); err != nil {
+		return "", false
+	}
+	v, ok := f.azure.versions.Load(u.String())
+	if !ok {
+		return "", false
+	}
+	return v.(string), true
+}
+
+// set stores value into the Key Vault secret rawurl and returns the new
+// version.
+func (f *fetcher) set(ctx context.Context, rawurl, value string) (string, error) {
+	u, err := f.parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "https" {
+		return "", fmt.Errorf("Invalid url - %s: only Key Vault secrets can be set", rawurl)
+	}
+	if f.dryRun {
+		return dryRunValue, f.azure.Validate(u)
+	}
+	f.logger.Printf("setting secret %q of %s", secretName(rawurl), u.Host)
+	var version string
+	err = f.withTimeout(ctx, rawurl, func(ctx context.Context) (err error) {
+		version, err = f.azure.setSecret(ctx, u, value)
+		return err
+	})
+	return version, err
+}
+
+// withDeadline returns ctx bounded by the deadline of a rendering.
+func (f *fetcher) withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if f.deadline > 0 {
+		return context.WithTimeout(ctx, f.deadline)
+	}
+	return context.WithCancel(ctx)
+}
+
+// withTimeout calls fn with a context bounded by the timeout of fetching
+// rawurl.
+func (f *fetcher) withTimeout(ctx context.Context, rawurl string, fn func(ctx context.Context) error) error {
+	parent := ctx
+	if f.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.timeout)
+		defer cancel()
+	}
+	err := fn(ctx)
+	if err != nil && f.deadline > 0 && parent.Err() == context.DeadlineExceeded {
+		return f.notResolved(rawurl)
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out fetching secret %q after %v", secretName(rawurl), f.timeout)
+	}
+	return err
+}
+
+// notResolved is the error of the secret rawurl not fetched before the
+// deadline of the rendering.
+func (f *fetcher) notResolved(rawurl string) error {
+	return fmt.Errorf("secret %q not resolved before the deadline of %v", secretName(rawurl), f.deadline)
+}
+
+// secretProperties fetches the Key Vault secret rawurl for its
+// properties. It returns nil in dry-run mode.
+func (f *fetcher) secretProperties(ctx context.Context, rawurl string) (*azureSecret, error) {
+	s, err := f.fetchProperties(ctx, rawurl)
+	f.mu.Lock()
+	f.results[rawurl] = err
+	f.mu.Unlock()
+	return s, err
+}
+
+func (f *fetcher) fetchProperties(ctx context.Context, rawurl string) (*azureSecret, error) {
+	u, err := f.parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("secret properties are only supported for Azure Key Vault: %s", rawurl)
+	}
+	if f.dryRun {
+		return nil, f.azure.Validate(u)
+	}
+	key := u.String()
+	f.mu.Lock()
+	s, ok := f.properties[key]
+	f.mu.Unlock()
+	if ok && !f.noCache {
+		f.logger.Printf("cache hit for %s", key)
+		return s, nil
+	}
+	f.logger.Printf("fetching secret %q from %s", secretName(rawurl), u.Host)
+	err = f.withTimeout(ctx, rawurl, func(ctx context.Context) (err error) {
+		s, err = f.azure.secret(ctx, u)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.properties[key] = s
+	f.secretCache[key] = s.Value
+	f.sources[s.Value] = rawurl
+	f.mu.Unlock()
+	return s, nil
+}
+
+// fetchTag returns the tag of the Key Vault secret rawurl, or an empty
+// string when the secret has no such tag.
+func (f *fetcher) fetchTag(ctx context.Context, rawurl, tag string) (string, error) {
+	s, err := f.secretProperties(ctx, rawurl)
+	if err != nil || s == nil {
+		return dryRunValue, err
+	}
+	return s.Tags[tag], nil
+}
+
+// fetchContentType returns the content type of the Key Vault secret
+// rawurl.
+func (f *fetcher) fetchContentType(ctx context.Context, rawurl string) (string, error) {
+	s, err := f.secretProperties(ctx, rawurl)
+	if err != nil || s == nil {
+		return dryRunValue, err
+	}
+	return s.ContentType, nil
+}
+
+// fetchAll fetches every enabled secret of the Key Vault rawurl with up
+// to concurrency workers and returns them as KEY=value lines, the keys
+// being the secret names with prefix as env keys. It returns no lines in
+// dry-run mode.
+func (f *fetcher) fetchAll(ctx context.Context, rawurl, prefix string, concurrency int) ([]envLine, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	u = lowerHost(u)
+	if err := f.azure.validateVault(u); err != nil || f.dryRun {
+		return nil, err
+	}
+	vault := "https://" + u.Host
+	f.logger.Printf("listing secrets of %s", u.Host)
+	var names []string
+	err = f.withTimeout(ctx, rawurl, func(ctx context.Context) (err error) {
+		names, err = f.azure.secretNames(ctx, vault)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	rawurls := make([]string, len(names))
+	refs := make([]secretRef, len(names))
+	for i, name := range names {
+		rawurls[i] = vault + "/secrets/" + name
+		refs[i] = secretRef{rawurl: rawurls[i]}
+	}
+	if concurrency > 0 {
+		f.prefetch(ctx, refs, concurrency)
+	}
+	lines := make([]envLine, len(names))
+	for i, name := range names {
+		v, err := f.kv(ctx, rawurls[i])
+		if err != nil {
+			return nil, err
+		}
+		key := envKeyName(prefix + name)
+		lines[i] = envLine{key: key, value: v, line: key + "=" + v}
+	}
+	return lines, nil
+}
+
+// envKeyName turns name into an env key: upper case letters, digits and
+// underscores not starting with a digit.
+func envKeyName(name string) string {
+	key := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z':
+			return r - 'a' + 'A'
+		case 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+	if key != "" && '0' <= key[0] && key[0] <= '9' {
+		key = "_" + key
+	}
+	return key
+}
+
+// source returns the reference a non-empty secret v was fetched from.
+func (f *fetcher) source(v string) (string, bool) {
+	if v == "" {
+		return "", false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rawurl, ok := f.sources[v]
+	return rawurl, ok
+}
+
+// describe names the secret v was fetched from, or says that v is a
+// value when it was not fetched.
+func (f *fetcher) describe(v string) string {
+	rawurl, ok := f.source(v)
+	if !ok {
+		return "value"
+	}
+	return fmt.Sprintf("secret %q", secretName(rawurl))
+}
+
+// prefetch fetches refs with up to concurrency workers to fill the
+// cache. Failures are left for the rendering pass to report.
+func (f *fetcher) prefetch(ctx context.Context, refs []secretRef, concurrency int) {
+	if f.noCache {
+		// The secrets would be fetched again when rendered.
+		return
+	}
+	p := newProgress(f.progress, len(refs))
+	defer p.clear()
+	ch := make(chan secretRef)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ref := range ch {
+				f.load(ctx, ref)
+				p.done()
+			}
+		}()
+	}
+	for _, ref := range refs {
+		ch <- ref
+	}
+	close(ch)
+	wg.Wait()
+}
+
+// progress writes the counter of the fetches of a prefetch on a line of
+// w, which nil disables.
+type progress struct {
+	w     io.Writer
+	mu    sync.Mutex
+	n     int
+	total int
+	// width is the length of the last counter written, to clear it.
+	width int
+}
+
+func newProgress(w io.Writer, total int) *progress {
+	p := &progress{w: w, total: total}
+	if total > 0 {
+		p.write()
+	}
+	return p
+}
+
+// done counts a completed fetch.
+func (p *progress) done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.n++
+	p.write()
+}
+
+func (p *progress) write() {
+	if p.w == nil {
+		return
+	}
+	s := fmt.Sprintf("vaultenv: fetched %d/%d secrets", p.n, p.total)
+	p.width = len(s)
+	fmt.Fprintf(p.w, "\r%s", s)
+}
+
+// clear erases the counter.
+func (p *progress) clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.w == nil || p.width == 0 {
+		return
+	}
+	fmt.Fprintf(p.w, "\r%s\r", strings.Repeat(" ", p.width))
+	p.width = 0
+}
+
+// secretName returns the name of the secret referenced by rawurl for
+// messages, falling back to rawurl itself.
+func secretName(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Scheme != "https" {
+		return rawurl
+	}
+	name, _, err := secretPath(u)
+	if err != nil {
+		return rawurl
+	}
+	return name
+}
+
+// masked returns v, or maskValue in mask mode.
+func (f *fetcher) masked(v string, err error) (string, error) {
+	if err != nil || !f.mask {
+		return v, err
+	}
+	return maskValue, nil
+}
+
+// placeholder reports whether v stands in for a secret in dry-run or
+// mask mode.
+func (f *fetcher) placeholder(v string) bool {
+	return (f.dryRun && v == dryRunValue) || (f.mask && v == maskValue)
+}
+
+// kv is fetch as seen by templates.
+func (f *fetcher) kv(ctx context.Context, rawurl string) (string, error) {
+	return f.masked(f.fetchOrEmpty(ctx, rawurl))
+}
+
+// fetchOrEmpty fetches rawurl, and returns an empty value when the secret
+// does not exist and allowMissing is set.
+func (f *fetcher) fetchOrEmpty(ctx context.Context, rawurl string) (string, error) {
+	v, err := f.fetch(ctx, rawurl)
+	if f.allowMissing && isNotFound(err) {
+		f.logger.Printf("secret %q does not exist, rendered as empty", secretName(rawurl))
+		return "", nil
+	}
+	return v, err
+}
+
+// fetchOr is like fetch but returns fallback when the secret does not
+// exist.
+func (f *fetcher) fetchOr(ctx context.Context, rawurl, fallback string) (string, error) {
+	v, err := f.fetch(ctx, rawurl)
+	if isNotFound(err) {
+		return fallback, nil
+	}
+	return f.masked(v, err)
+}
+
+// fetchFile writes the value of the secret rawurl to the file path, only
+// readable by the user, and returns path. The file is not written in
+// dry-run mode.
+func (f *fetcher) fetchFile(ctx context.Context, rawurl, path string) (string, error) {
+	v, err := f.fetchOrEmpty(ctx, rawurl)
+	if err != nil || f.dryRun {
+		return path, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", fmt.Errorf("kvFile: %v", err)
+	}
+	if err := file.Chmod(0600); err != nil {
+		file.Close()
+		return "", fmt.Errorf("kvFile: %v", err)
+	}
+	if _, err := io.WriteString(file, v); err != nil {
+		file.Close()
+		return "", fmt.Errorf("kvFile: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return "", fmt.Errorf("kvFile: %v", err)
+	}
+	f.logger.Printf("wrote secret %q to %s", secretName(rawurl), path)
+	return path, nil
+}
+
+// fetchJSON fetches a secret holding a JSON object and returns its key
+// field. Fields that are not strings are returned as JSON.
+func (f *fetcher) fetchJSON(ctx context.Context, rawurl, key string) (string, error) {
+	return f.masked(f.jsonField(ctx, rawurl, key))
+}
+
+func (f *fetcher) jsonField(ctx context.Context, rawurl, key string) (string, error) {
+	v, err := f.fetchOrEmpty(ctx, rawurl)
+	if err != nil || f.placeholder(v) || v == "" {
+		return v, err
+	}
+	fields, err := jsonFields(rawurl, v)
+	if err != nil {
+		return "", err
+	}
+	field, ok := fields[key]
+	if !ok {
+		return "", fmt.Errorf("secret %q has no key %q", secretName(rawurl), key)
+	}
+	return field, nil
+}
+
+// jsonFields returns the fields of the JSON object v of rawurl. Fields
+// that are not strings are JSON encoded.
+func jsonFields(rawurl, v string) (map[string]string, error) {
+	var object map[string]interface{}
+	if err := json.Unmarshal([]byte(v), &object); err != nil {
+		return nil, fmt.Errorf("secret %q is not a JSON object: %v", secretName(rawurl), err)
+	}
+	fields := make(map[string]string, len(object))
+	for k, field := range object {
+		if s, ok := field.(string); ok {
+			fields[k] = s
+			continue
+		}
+		b, err := json.Marshal(field)
+		if err != nil {
+			return nil, err
+		}
+		fields[k] = string(b)
+	}
+	return fields, nil
+}
+
+// fetchFields returns the fields of the secret rawurl holding a JSON
+// object. A missing secret with allowMissing, and a secret in dry-run
+// mode, have no fields, and the fields are masked in mask mode.
+func (f *fetcher) fetchFields(ctx context.Context, rawurl string) (map[string]string, error) {
+	v, err := f.fetchOrEmpty(ctx, rawurl)
+	if err != nil || (f.dryRun && v == dryRunValue) || v == "" {
+		return nil, err
+	}
+	fields, err := jsonFields(rawurl, v)
+	if err != nil {
+		return nil, err
+	}
+	if f.mask {
+		for k := range fields {
+			fields[k] = maskValue
+		}
+	}
+	return fields, nil
+}
+
+// fetchSplit returns the parts of the secret rawurl separated by sep. An
+// empty secret has no parts, and the parts are masked in mask mode.
+func (f *fetcher) fetchSplit(ctx context.Context, rawurl, sep string) ([]string, error) {
+	v, err := f.fetchOrEmpty(ctx, rawurl)
+	if err != nil || v == "" {
+		return nil, err
+	}
+	parts := strings.Split(v, sep)
+	if f.mask {
+		for i := range parts {
+			parts[i] = maskValue
+		}
+	}
+	return parts, nil
+}
@@ -0,0 +1,151 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVerbose(t *testing.T) {
+	var log bytes.Buffer
+	f := newFetcher(&dummyClient{})
+	f.logger.SetOutput(&log)
+	for i := 0; i < 2; i++ {
+		if _, err := f.fetch(context.Background(), "https://example.vault.azure.net/secrets/pass"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range []string{
+		`using credential managed identity for https://vault.azure.net`,
+		`fetching secret "pass" from example.vault.azure.net`,
+		`fetched secret "pass" in `,
+		`cache hit for https://example.vault.azure.net/secrets/pass`,
+	} {
+		if !strings.Contains(log.String(), s) {
+			t.Fatalf("got:%s want:%s", log.String(), s)
+		}
+	}
+	if strings.Contains(log.String(), "mysecretvalue1") {
+		t.Fatalf("value must not be logged: %s", log.String())
+	}
+}
+
+func TestHostCase(t *testing.T) {
+	client := &dummyClient{}
+	f := newFetcher(client)
+	f.defaultVault = "https://EXAMPLE.vault.azure.net"
+	for _, rawurl := range []string{
+		"https://example.vault.azure.net/secrets/pass",
+		"https://Example.Vault.Azure.NET/secrets/pass",
+		"HTTPS://EXAMPLE.VAULT.AZURE.NET/secrets/pass",
+		"pass",
+	} {
+		v, err := f.fetch(context.Background(), rawurl)
+		if err != nil || v != "mysecretvalue1" {
+			t.Fatalf("got:%s, %v want:mysecretvalue1 for %s", v, err, rawurl)
+		}
+	}
+	var fetched []string
+	for _, req := range client.requests {
+		if strings.Contains(req, "/secrets/") {
+			fetched = append(fetched, req)
+		}
+	}
+	if len(fetched) != 1 || !strings.HasPrefix(fetched[0], "https://example.vault.azure.net/") || f.stats.cacheHits != 3 {
+		t.Fatalf("got:%v and %d cache hits want:one request to example.vault.azure.net", fetched, f.stats.cacheHits)
+	}
+}
+
+func TestDefaultVault(t *testing.T) {
+	template := `PASSWORD={{ kv "pass" }}
+ROTATED={{ kv "rotated/v1" }}
+FULL={{ kv "https://other.vault.azure.net/secrets/base64" | base64d }}
+`
+	expected := `PASSWORD=mysecretvalue1
+ROTATED=rotated-v1
+FULL=mysecretvalue1
+`
+	for _, vault := range []string{"example", "https://example.vault.azure.net/"} {
+		c := &dummyClient{}
+		f := newFetcher(c)
+		f.defaultVault = vault
+		var b bytes.Buffer
+		if err := filter(context.Background(), f, strings.NewReader(template), &b, Options{Concurrency: 2}); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != expected {
+			t.Fatalf("got:%s want:%s", b.String(), expected)
+		}
+		for _, req := range c.requests {
+			if strings.Contains(req, "/secrets/pass") && !strings.HasPrefix(req, "https://example.vault.azure.net/secrets/pass?") {
+				t.Fatalf("got:%s want:request to the default vault", req)
+			}
+		}
+	}
+
+	_, err := newFetcher(&dummyClient{}).fetch(context.Background(), "pass")
+	if err == nil || !strings.Contains(err.Error(), "VAULTENV_DEFAULT_VAULT") {
+		t.Fatalf("got:%v want:default vault error", err)
+	}
+}
+
+func TestDefaultVaultQuery(t *testing.T) {
+	f := newFetcher(&dummyClient{})
+	f.defaultVault = "example"
+	v, err := f.fetch(context.Background(), "base64?encoding=base64")
+	if err != nil || v != "mysecretvalue1" {
+		t.Fatalf("got:%s, %v want:mysecretvalue1", v, err)
+	}
+	if _, err := f.fetch(context.Background(), "pass?bogus=1"); err == nil || !strings.Contains(err.Error(), "bogus") {
+		t.Fatalf("got:%v want:unknown option error", err)
+	}
+}
+
+// concurrencyClient records the maximum number of concurrent secret
+// requests.
+type concurrencyClient struct {
+	dummyClient
+	mu       sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (c *concurrencyClient) Do(req *http.Request) (*http.Response, error) {
+	if strings.HasPrefix(req.URL.Path, "/secrets/") {
+		c.mu.Lock()
+		c.inFlight++
+		if c.inFlight > c.max {
+			c.max = c.inFlight
+		}
+		c.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		defer func() {
+			c.mu.Lock()
+			c.inFlight--
+			c.mu.Unlock()
+		}()
+	}
+	return c.dummyClient.Do(req)
+}
+
+func TestMaxPerVault(t *testing.T) {
+	var refs []secretRef
+	for i := 1; i <= 8; i++ {
+		refs = append(refs, secretRef{rawurl: fmt.Sprintf("https://example.vault.azure.net/secrets/rotated/v%d", i)})
+	}
+	c := &concurrencyClient{}
+	f := newFetcher(c)
+	f.maxPerVault = 2
+	f.prefetch(context.Background(), refs, 8)
+	if c.max != 2 {
+		t.Fatalf("got:%d want:2 concurrent requests", c.max)
+	}
+	if len(f.secretCache) != 8 {
+		t.Fatalf("got:%v want:8 fetched secrets", f.secretCache)
+	}
+}
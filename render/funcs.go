@@ -0,0 +1,290 @@
+package render
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// funcMap returns the functions available in the template src rendered
+// with ctx.
+func funcMap(ctx context.Context, f *fetcher, src *source, opts Options) template.FuncMap {
+	return template.FuncMap{
+		"include": func(name string) (string, error) {
+			return include(ctx, f, src, name, opts)
+		},
+		"file": func(name string) (string, error) {
+			return readFile(src, name)
+		},
+		"kv": func(rawurl string) (string, error) {
+			return f.kv(ctx, rawurl)
+		},
+		"kvName": func(vault, name string) (string, error) {
+			return f.kv(ctx, f.azure.secretURL(vault, name, ""))
+		},
+		"kvNameVersion": func(vault, name, version string) (string, error) {
+			return f.kv(ctx, f.azure.secretURL(vault, name, version))
+		},
+		"kvOr": func(rawurl, fallback string) (string, error) {
+			return f.fetchOr(ctx, rawurl, fallback)
+		},
+		"kvJSON": func(rawurl, key string) (string, error) {
+			return f.fetchJSON(ctx, rawurl, key)
+		},
+		"kvSplit": func(rawurl, sep string) ([]string, error) {
+			return f.fetchSplit(ctx, rawurl, sep)
+		},
+		"kvFields": func(rawurl string) (map[string]string, error) {
+			return f.fetchFields(ctx, rawurl)
+		},
+		"kvFile": func(rawurl, name string) (string, error) {
+			path, err := src.resolve(name)
+			if err != nil {
+				return "", fmt.Errorf("kvFile: %v", err)
+			}
+			return f.fetchFile(ctx, rawurl, path)
+		},
+		"kvAll": func(vault, prefix string) (string, error) {
+			env, err := f.fetchAll(ctx, vault, prefix, opts.Concurrency)
+			if err != nil {
+				return "", err
+			}
+			lines := make([]string, len(env))
+			for i, l := range env {
+				lines[i] = l.line
+			}
+			return src.addBlock(strings.Join(lines, "\n"), env), nil
+		},
+		"kvTag": func(rawurl, tag string) (string, error) {
+			return f.fetchTag(ctx, rawurl, tag)
+		},
+		"kvContentType": func(rawurl string) (string, error) {
+			return f.fetchContentType(ctx, rawurl)
+		},
+		"kvCert": func(rawurl string) (string, error) {
+			return f.fetchCert(ctx, rawurl, isCertificate)
+		},
+		"kvCertKey": func(rawurl string) (string, error) {
+			return f.fetchCert(ctx, rawurl, isPrivateKey)
+		},
+
+		"env":   os.Getenv,
+		"envOr": envOr,
+
+		"default":  defaultValue,
+		"required": requiredValue,
+		"coalesce": coalesce,
+		"base64":   base64Encode,
+		"base64d":  f.base64Decode,
+		"sha256":   f.hashFunc(sha256.New),
+		"sha1":     f.hashFunc(sha1.New),
+		"md5":      f.hashFunc(md5.New),
+
+		"trimSpace":  strings.TrimSpace,
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"trimPrefix": trimPrefix,
+		"trimSuffix": trimSuffix,
+		"indent":     indent,
+		"nindent":    nindent,
+		"urlencode":  url.QueryEscape,
+
+		"randAlphaNum": randAlphaNum,
+		"uuid":         uuid,
+	}
+}
+
+// trimPrefix is strings.TrimPrefix taking s last for pipelines.
+func trimPrefix(prefix, s string) string {
+	return strings.TrimPrefix(s, prefix)
+}
+
+// trimSuffix is strings.TrimSuffix taking s last for pipelines.
+func trimSuffix(suffix, s string) string {
+	return strings.TrimSuffix(s, suffix)
+}
+
+// indent indents the lines of s after the first by n spaces, to embed a
+// multi-line value like a PEM in YAML after a key.
+func indent(n int, s string) string {
+	return strings.Replace(s, "\n", "\n"+strings.Repeat(" ", n), -1)
+}
+
+// nindent indents every line of s by n spaces after a newline, to embed
+// a multi-line value like a PEM in a YAML block scalar.
+func nindent(n int, s string) string {
+	return "\n" + strings.Repeat(" ", n) + indent(n, s)
+}
+
+// envOr returns the environment variable name, or def when it is unset
+// or empty.
+func envOr(name, def string) string {
+	return defaultValue(def, os.Getenv(name))
+}
+
+// defaultValue returns def when v is empty. It takes v last so that it
+// can be used in a pipeline: {{ kv "..." | default "none" }}.
+func defaultValue(def, v string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+// coalesce returns the first non-empty of values, or an empty string,
+// e.g. {{ coalesce (kvOr "..." "") (kvOr "..." "") "none" }}.
+func coalesce(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// requiredValue fails with msg when v is empty, e.g.
+// {{ kv "..." | required "DB password must exist" }}.
+func requiredValue(msg, v string) (string, error) {
+	if v == "" {
+		return "", errors.New(msg)
+	}
+	return v, nil
+}
+
+func base64Encode(v string) string {
+	return base64.StdEncoding.EncodeToString([]byte(v))
+}
+
+func (f *fetcher) base64Decode(v string) (string, error) {
+	if f.placeholder(v) {
+		return v, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return "", fmt.Errorf("%s is not valid base64: %v", f.describe(v), err)
+	}
+	return string(b), nil
+}
+
+// hashFunc returns a function writing the hex digest of its input with
+// the hash of newHash, to derive an identifier from a secret without
+// revealing it. Placeholders are kept as is.
+func (f *fetcher) hashFunc(newHash func() hash.Hash) func(string) string {
+	return func(v string) string {
+		if f.placeholder(v) {
+			return v
+		}
+		h := newHash()
+		h.Write([]byte(v))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+}
+
+const alphaNum = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// randAlphaNum returns a cryptographically random string of n letters
+// and digits.
+func randAlphaNum(n int) (string, error) {
+	if n < 0 {
+		return "", fmt.Errorf("randAlphaNum: negative length %d", n)
+	}
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(alphaNum)))
+	for i := range b {
+		j, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = alphaNum[j.Int64()]
+	}
+	return string(b), nil
+}
+
+// uuid returns a random version 4 UUID.
+func uuid() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// builtinFuncs are the functions predefined by text/template.
+var builtinFuncs = []string{
+	"and", "call", "eq", "ge", "gt", "html", "index", "js", "le", "len", "lt", "ne",
+	"not", "or", "print", "printf", "println", "slice", "urlquery",
+}
+
+// undefinedFunc matches the parse error of a call of an unknown function.
+var undefinedFunc = regexp.MustCompile(`function "([^"]*)" not defined`)
+
+// hintFuncs adds to err, when it is the parse error of an unknown
+// function, the closest of funcs and the builtin functions, if any, and
+// all of them.
+func hintFuncs(err error, funcs template.FuncMap) error {
+	if err == nil {
+		return nil
+	}
+	m := undefinedFunc.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err
+	}
+	names := append([]string{}, builtinFuncs...)
+	for name := range funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	closest, distance := "", 3
+	for _, name := range names {
+		if d := editDistance(strings.ToLower(m[1]), strings.ToLower(name)); d < distance {
+			closest, distance = name, d
+		}
+	}
+	if closest != "" {
+		return fmt.Errorf("%w, did you mean %s? available functions: %s", err, closest, strings.Join(names, ", "))
+	}
+	return fmt.Errorf("%w, available functions: %s", err, strings.Join(names, ", "))
+}
+
+// editDistance returns the Levenshtein distance of a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if d := prev[j] + 1; d < cur[j] {
+				cur[j] = d
+			}
+			if d := cur[j-1] + 1; d < cur[j] {
+				cur[j] = d
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,226 @@
+package render
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcpSecretVersion matches the resource name of a secret version.
+var gcpSecretVersion = regexp.MustCompile(`^projects/[^/]+/secrets/[^/]+/versions/[^/]+$`)
+
+const gcpScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// gcpBackend fetches secrets from Google Secret Manager referenced as
+// gcp://projects/<project>/secrets/<secret>/versions/<version> or by the
+// bare resource name. It authenticates with Application Default
+// Credentials.
+type gcpBackend struct {
+	client HTTPClient
+
+	mu    sync.Mutex
+	token string
+}
+
+// gcpResourceName returns the secret version resource name of u.
+func gcpResourceName(u *url.URL) (string, error) {
+	name := strings.TrimPrefix(u.Path, "/")
+	if u.Scheme == "gcp" {
+		name = u.Host + u.Path
+	}
+	if !gcpSecretVersion.MatchString(name) {
+		return "", fmt.Errorf("Invalid url - %s: want projects/<project>/secrets/<secret>/versions/<version>", u)
+	}
+	return name, nil
+}
+
+func (g *gcpBackend) Validate(u *url.URL) error {
+	_, err := gcpResourceName(u)
+	return err
+}
+
+func (g *gcpBackend) Fetch(ctx context.Context, u *url.URL) (string, error) {
+	name, err := gcpResourceName(u)
+	if err != nil {
+		return "", err
+	}
+	token, err := g.getToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("GET", "https://secretmanager.googleapis.com/v1/"+name+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Accept", "application/json")
+	res, err := g.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	decoder := json.NewDecoder(res.Body)
+	if res.StatusCode != 200 {
+		var e struct {
+			Error struct {
+				Message string `json:"message"`
+				Status  string `json:"status"`
+			} `json:"error"`
+		}
+		decoder.Decode(&e)
+		return "", &responseError{
+			method:     "access",
+			url:        name,
+			status:     res.Status + ": " + e.Error.Status + " " + e.Error.Message,
+			statusCode: res.StatusCode,
+			code:       e.Error.Status,
+		}
+	}
+	var result struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := decoder.Decode(&result); err != nil {
+		return "", err
+	}
+	b, err := base64.StdEncoding.DecodeString(result.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("invalid payload of %s: %v", name, err)
+	}
+	return string(b), nil
+}
+
+// getToken returns an access token of the Application Default
+// Credentials: the GOOGLE_APPLICATION_CREDENTIALS file, the gcloud
+// credentials file, or the metadata server.
+func (g *gcpBackend) getToken(ctx context.Context) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.token != "" {
+		return g.token, nil
+	}
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		path = gcloudCredentialsPath()
+		if _, err := os.Stat(path); err != nil {
+			path = ""
+		}
+	}
+	var req *http.Request
+	var err error
+	if path != "" {
+		req, err = gcpTokenRequest(path)
+	} else {
+		req, err = http.NewRequest("GET", "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		if err == nil {
+			req.Header.Add("Metadata-Flavor", "Google")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	token, err := requestToken(ctx, g.client, req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get Google credentials: %v", err)
+	}
+	g.token = token.value
+	return token.value, nil
+}
+
+func gcloudCredentialsPath() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("APPDATA"), "gcloud", "application_default_credentials.json")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+}
+
+// gcpTokenRequest builds the token request of a credentials file.
+func gcpTokenRequest(path string) (*http.Request, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var creds struct {
+		Type         string `json:"type"`
+		ClientEmail  string `json:"client_email"`
+		PrivateKey   string `json:"private_key"`
+		TokenURI     string `json:"token_uri"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("invalid credentials file %s: %v", path, err)
+	}
+	if creds.TokenURI == "" {
+		creds.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	values := url.Values{}
+	switch creds.Type {
+	case "service_account":
+		key, err := parseGcpPrivateKey(creds.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key in %s: %v", path, err)
+		}
+		now := time.Now()
+		assertion, err := signJWT(key, nil, map[string]interface{}{
+			"iss":   creds.ClientEmail,
+			"scope": gcpScope,
+			"aud":   creds.TokenURI,
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Hour).Unix(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		values.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		values.Set("assertion", assertion)
+	case "authorized_user":
+		values.Set("grant_type", "refresh_token")
+		values.Set("client_id", creds.ClientID)
+		values.Set("client_secret", creds.ClientSecret)
+		values.Set("refresh_token", creds.RefreshToken)
+	default:
+		return nil, fmt.Errorf("unsupported credentials type %q in %s", creds.Type, path)
+	}
+	req, err := http.NewRequest("POST", creds.TokenURI, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+func parseGcpPrivateKey(s string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("not a PEM key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return rsaKey, nil
+}
@@ -0,0 +1,74 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGcpSecretManager(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	serviceAccount, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "vaultenv@p.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    "https://oauth2.googleapis.com/token",
+	})
+	dir := writeFiles(t, map[string]string{
+		"service_account.json": string(serviceAccount),
+		"authorized_user.json": `{"type": "authorized_user", "client_id": "id", "client_secret": "secret", "refresh_token": "token"}`,
+	})
+	defer os.RemoveAll(dir)
+	defer os.Unsetenv("GOOGLE_APPLICATION_CREDENTIALS")
+
+	for _, creds := range []string{"service_account.json", "authorized_user.json"} {
+		os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", filepath.Join(dir, creds))
+		var b bytes.Buffer
+		template := `PASSWORD={{ kv "gcp://projects/p/secrets/pass/versions/latest" }}
+BARE={{ kv "projects/p/secrets/pass/versions/latest" }}
+`
+		expected := `PASSWORD=mysecretvalue7
+BARE=mysecretvalue7
+`
+		if err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(template), &b, Options{}); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != expected {
+			t.Fatalf("got:%s want:%s", b.String(), expected)
+		}
+	}
+}
+
+func TestGcpSecretManagerErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"authorized_user.json": `{"type": "authorized_user", "client_id": "id", "client_secret": "secret", "refresh_token": "token"}`,
+	})
+	defer os.RemoveAll(dir)
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", filepath.Join(dir, "authorized_user.json"))
+	defer os.Unsetenv("GOOGLE_APPLICATION_CREDENTIALS")
+
+	f := newFetcher(&dummyClient{})
+	_, err := f.fetch(context.Background(), "gcp://projects/p/secrets/missing/versions/latest")
+	if !isNotFound(err) || !strings.Contains(err.Error(), "NOT_FOUND") {
+		t.Fatalf("got:%v want:NOT_FOUND", err)
+	}
+	_, err = f.fetch(context.Background(), "gcp://projects/p/secrets/forbidden/versions/1")
+	if err == nil || isNotFound(err) || !strings.Contains(err.Error(), "PERMISSION_DENIED") {
+		t.Fatalf("got:%v want:PERMISSION_DENIED", err)
+	}
+	if _, err := f.fetch(context.Background(), "gcp://projects/p/secrets/pass"); err == nil {
+		t.Fatalf("must be error")
+	}
+}
@@ -0,0 +1,81 @@
+package render
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// hashicorpBackend fetches a field of a HashiCorp Vault KV v2 secret
+// referenced as vault://host/mount/data/path#field. When the host is
+// omitted the server is taken from VAULT_ADDR, and VAULT_TOKEN is used
+// for authentication like the Vault CLI does.
+type hashicorpBackend struct {
+	client HTTPClient
+}
+
+func (h *hashicorpBackend) Validate(u *url.URL) error {
+	if strings.Trim(u.Path, "/") == "" {
+		return fmt.Errorf("Invalid url - %s: missing secret path", u)
+	}
+	if u.Fragment == "" {
+		return fmt.Errorf("Invalid url - %s: missing #field", u)
+	}
+	return nil
+}
+
+func (h *hashicorpBackend) Fetch(ctx context.Context, u *url.URL) (string, error) {
+	if err := h.Validate(u); err != nil {
+		return "", err
+	}
+	addr := "https://" + u.Host
+	if u.Host == "" {
+		addr = os.Getenv("VAULT_ADDR")
+		if addr == "" {
+			return "", fmt.Errorf("Invalid url - %s: no host and VAULT_ADDR is not set", u)
+		}
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		return "", errors.New("VAULT_TOKEN is not set")
+	}
+	endpoint := strings.TrimSuffix(addr, "/") + "/v1/" + strings.TrimPrefix(u.Path, "/")
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Add("X-Vault-Token", token)
+	req.Header.Add("Accept", "application/json")
+	res, err := h.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", &responseError{method: "GET", url: endpoint, status: res.Status, statusCode: res.StatusCode}
+	}
+	var result struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	decoder := json.NewDecoder(res.Body)
+	if err = decoder.Decode(&result); err != nil {
+		return "", err
+	}
+	v, ok := result.Data.Data[u.Fragment]
+	if !ok {
+		return "", fmt.Errorf("field %q not found in %s", u.Fragment, u.Path)
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("field %q in %s is not a string", u.Fragment, u.Path)
+	}
+	return s, nil
+}
@@ -0,0 +1,40 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHashicorpVault(t *testing.T) {
+	os.Setenv("VAULT_TOKEN", "VAULT_TOKEN")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	var b bytes.Buffer
+	template := `PASSWORD={{ kv "vault://hashicorp.example.com/secret/data/app#password" }}
+`
+	expected := `PASSWORD=mysecretvalue3
+`
+	r := strings.NewReader(template)
+	if err := filter(context.Background(), newFetcher(&dummyClient{}), r, &b, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != expected {
+		t.Fatalf("got:%s want:%s", b.String(), expected)
+	}
+}
+
+func TestHashicorpVaultMissingField(t *testing.T) {
+	os.Setenv("VAULT_TOKEN", "VAULT_TOKEN")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	var b bytes.Buffer
+	template := `PASSWORD={{ kv "vault://hashicorp.example.com/secret/data/app#nothing" }}
+`
+	r := strings.NewReader(template)
+	if err := filter(context.Background(), newFetcher(&dummyClient{}), r, &b, Options{}); err == nil {
+		t.Fatalf("must be error")
+	}
+}
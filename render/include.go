@@ -0,0 +1,117 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// maxIncludeDepth limits how deeply templates can include each other.
+const maxIncludeDepth = 16
+
+// source is a template being rendered.
+type source struct {
+	// path is the file of the template, empty for stdin.
+	path string
+	// parent is the template including this one.
+	parent *source
+	// env collects the .env lines rendered by the template lines.
+	env []envLine
+	// blocks are the .env lines of the output of include and kvAll in the
+	// line being rendered, keyed by the output.
+	blocks map[string][]envLine
+}
+
+// addBlock records the .env lines env of the output text of a function
+// in the line being rendered, and returns text.
+func (s *source) addBlock(text string, env []envLine) string {
+	if s.blocks == nil {
+		s.blocks = map[string][]envLine{}
+	}
+	s.blocks[text] = env
+	return text
+}
+
+// dir is the directory relative paths in the template are resolved from.
+func (s *source) dir() string {
+	if s.path == "" {
+		return ""
+	}
+	return filepath.Dir(s.path)
+}
+
+// resolve returns the absolute path of the file name relative to s.
+func (s *source) resolve(name string) (string, error) {
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(s.dir(), path)
+	}
+	return filepath.Abs(path)
+}
+
+// readFile returns the content of the file name, relative to the
+// template src.
+func readFile(src *source, name string) (string, error) {
+	path, err := src.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("file: %v", err)
+	}
+	return string(b), nil
+}
+
+// parseTemplates parses the files paths into t, so that the templates
+// they define can be executed by the template action. Parse errors are
+// reported with the file name.
+func parseTemplates(t *template.Template, paths []string) error {
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("include-template: %v", err)
+		}
+		if _, err := t.New(path).Parse(string(b)); err != nil {
+			return parsed(err)
+		}
+	}
+	return nil
+}
+
+// include renders the template file name, relative to the template src,
+// and returns its content without the final newline.
+func include(ctx context.Context, f *fetcher, src *source, name string, opts Options) (string, error) {
+	abs, err := src.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	depth := 0
+	for s := src; s != nil; s = s.parent {
+		depth++
+		if s.path == abs {
+			return "", fmt.Errorf("include cycle: %s includes %s", src.path, abs)
+		}
+	}
+	if depth > maxIncludeDepth {
+		return "", fmt.Errorf("include %s: too deeply nested", abs)
+	}
+	file, err := os.Open(abs)
+	if err != nil {
+		return "", fmt.Errorf("include: %v", err)
+	}
+	defer file.Close()
+	var b bytes.Buffer
+	opts.KeepGoing = false
+	opts.ValueOnly = false
+	included := &source{path: abs, parent: src}
+	if err := renderSource(ctx, f, included, file, &b, opts); err != nil {
+		return "", fmt.Errorf("include %s: %w", abs, err)
+	}
+	return src.addBlock(strings.TrimSuffix(b.String(), "\n"), included.env), nil
+}
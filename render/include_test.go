@@ -0,0 +1,200 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes files into a new temporary directory.
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "vaultenv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestInclude(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"common/common.tmpl": `PASSWORD={{ kv "https://example.vault.azure.net/secrets/pass" }}
+{{ include "nested.tmpl" }}
+`,
+		"common/nested.tmpl": `NESTED=1
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	var b bytes.Buffer
+	template := `USER=foo@example.com
+{{ include "` + filepath.Join(dir, "common/common.tmpl") + `" }}
+`
+	expected := `USER=foo@example.com
+PASSWORD=mysecretvalue1
+NESTED=1
+`
+	if err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(template), &b, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != expected {
+		t.Fatalf("got:%s want:%s", b.String(), expected)
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.tmpl": `{{ include "b.tmpl" }}`,
+		"b.tmpl": `{{ include "a.tmpl" }}`,
+	})
+	defer os.RemoveAll(dir)
+
+	for name, expected := range map[string]string{
+		"a.tmpl":       "include cycle",
+		"missing.tmpl": "missing.tmpl: no such file or directory",
+	} {
+		var b bytes.Buffer
+		template := `{{ include "` + filepath.Join(dir, name) + `" }}`
+		err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(template), &b, Options{})
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("got:%v want:%s", err, expected)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"certs/app.tmpl": `CA={{ file "ca.pem" | trimSpace | base64 }}
+`,
+		"certs/ca.pem": "-----BEGIN CERTIFICATE-----\n",
+	})
+	defer os.RemoveAll(dir)
+
+	var b bytes.Buffer
+	template := `{{ include "` + filepath.Join(dir, "certs/app.tmpl") + `" }}
+`
+	expected := `CA=LS0tLS1CRUdJTiBDRVJUSUZJQ0FURS0tLS0t
+`
+	if err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(template), &b, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != expected {
+		t.Fatalf("got:%s want:%s", b.String(), expected)
+	}
+
+	err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(`CA={{ file "missing.pem" }}`), &b, Options{})
+	if err == nil || !strings.Contains(err.Error(), "missing.pem: no such file or directory") {
+		t.Fatalf("got:%v want:no such file error", err)
+	}
+}
+
+func TestRenderFiles(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.tmpl": `# base
+USER=foo@example.com
+PASSWORD={{ kv "https://example.vault.azure.net/secrets/pass" }}
+`,
+		"prod.tmpl": `USER=prod@example.com
+`,
+		"broken.tmpl": `OK=1
+BROKEN={{ kv "https://example.vault.azure.net/secrets/forbidden" }}
+`,
+		"key.tmpl": `KEY={{ kv "https://example.vault.azure.net/secrets/multiline" }}
+USER=foo@example.com
+`,
+		"key-prod.tmpl": `KEY=prod
+`,
+	})
+	defer os.RemoveAll(dir)
+	base, prod, broken := filepath.Join(dir, "base.tmpl"), filepath.Join(dir, "prod.tmpl"), filepath.Join(dir, "broken.tmpl")
+
+	for _, c := range []struct {
+		opts     Options
+		expected string
+	}{
+		{Options{}, `# base
+USER=foo@example.com
+PASSWORD=mysecretvalue1
+USER=prod@example.com
+`},
+		{Options{Merge: true}, `# base
+PASSWORD=mysecretvalue1
+USER=prod@example.com
+`},
+	} {
+		var b bytes.Buffer
+		if err := filterFiles(context.Background(), newFetcher(&dummyClient{}), []string{base, prod}, &b, c.opts); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != c.expected {
+			t.Fatalf("got:%s want:%s", b.String(), c.expected)
+		}
+	}
+
+	// the lines of an overridden value are dropped with its key
+	var b bytes.Buffer
+	if err := filterFiles(context.Background(), newFetcher(&dummyClient{}), []string{filepath.Join(dir, "key.tmpl"), filepath.Join(dir, "key-prod.tmpl")}, &b, Options{Merge: true}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "USER=foo@example.com\nKEY=prod\n"; b.String() != expected {
+		t.Fatalf("got:%s want:%s", b.String(), expected)
+	}
+
+	b.Reset()
+	err := filterFiles(context.Background(), newFetcher(&dummyClient{}), []string{base, prod}, &b, Options{NoDuplicates: true})
+	if err == nil || !strings.Contains(err.Error(), `duplicate key "USER" on `+base+`:2 and `+prod+`:1`) {
+		t.Fatalf("got:%v want:duplicate key error", err)
+	}
+	err = filterFiles(context.Background(), newFetcher(&dummyClient{}), []string{base, prod}, &b, Options{NoDuplicates: true, Merge: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filterFiles(context.Background(), newFetcher(&dummyClient{}), []string{base, broken}, &b, Options{})
+	if err == nil || !strings.Contains(err.Error(), broken+": line 2: ") {
+		t.Fatalf("got:%v want:error at %s line 2", err, broken)
+	}
+}
+
+func TestIncludeTemplate(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"defs.tmpl": `{{ define "dbconn" }}postgres://app:{{ kv "https://example.vault.azure.net/secrets/pass" }}@db/app{{ end }}
+{{ define "user" }}foo@example.com{{ end }}
+`,
+		"broken.tmpl": `{{ define "broken" }}{{ kv }`,
+	})
+	defer os.RemoveAll(dir)
+
+	var b bytes.Buffer
+	template := `DATABASE_URL={{ template "dbconn" }}
+USER={{ template "user" }}
+`
+	expected := `DATABASE_URL=postgres://app:mysecretvalue1@db/app
+USER=foo@example.com
+`
+	for _, wholeFile := range []bool{false, true} {
+		b.Reset()
+		opts := Options{Templates: []string{filepath.Join(dir, "defs.tmpl")}, WholeFile: wholeFile}
+		if err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(template), &b, opts); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != expected {
+			t.Fatalf("got:%s want:%s", b.String(), expected)
+		}
+	}
+
+	opts := Options{Templates: []string{filepath.Join(dir, "broken.tmpl")}}
+	err := filter(context.Background(), newFetcher(&dummyClient{}), strings.NewReader(template), &b, opts)
+	if err == nil || !strings.Contains(err.Error(), "broken.tmpl:1") {
+		t.Fatalf("got:%v want:broken.tmpl:1", err)
+	}
+}
@@ -0,0 +1,100 @@
+package render
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// Content types of the secrets backing Key Vault certificates.
+const (
+	pemContentType    = "application/x-pem-file"
+	pkcs12ContentType = "application/x-pkcs12"
+)
+
+// fetchCert returns the PEM blocks of the certificate secret rawurl,
+// keeping those for which keep is true.
+func (f *fetcher) fetchCert(ctx context.Context, rawurl string, keep func(block *pem.Block) bool) (string, error) {
+	s, err := f.secretProperties(ctx, rawurl)
+	if err != nil || s == nil {
+		return dryRunValue, err
+	}
+	var blocks []*pem.Block
+	switch s.ContentType {
+	case pemContentType, "":
+		rest := []byte(s.Value)
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			blocks = append(blocks, block)
+		}
+	case pkcs12ContentType:
+		// Key Vault stores PKCS#12 certificates base64 encoded, without a
+		// password.
+		der, err := base64.StdEncoding.DecodeString(s.Value)
+		if err != nil {
+			return "", fmt.Errorf("secret %q is not a base64 PKCS#12 certificate: %v", secretName(rawurl), err)
+		}
+		if blocks, err = pkcs12Blocks(der); err != nil {
+			return "", fmt.Errorf("secret %q: %v", secretName(rawurl), err)
+		}
+	default:
+		return "", fmt.Errorf("secret %q is not a certificate: content type %s", secretName(rawurl), s.ContentType)
+	}
+	var b strings.Builder
+	for _, block := range blocks {
+		if keep(block) {
+			b.Write(pem.EncodeToMemory(block))
+		}
+	}
+	if b.Len() == 0 {
+		return "", fmt.Errorf("secret %q has no PEM block of the kind asked for", secretName(rawurl))
+	}
+	return f.masked(strings.TrimSuffix(b.String(), "\n"), nil)
+}
+
+// pkcs12Blocks returns the certificates, in the order of the PKCS#12 file
+// der without a password, and its private key in PKCS#8.
+func pkcs12Blocks(der []byte) ([]*pem.Block, error) {
+	blocks, err := pkcs12.ToPEM(der, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, block := range blocks {
+		// the bag attributes, like friendlyName, are not PEM headers
+		block.Headers = nil
+		if block.Type != "PRIVATE KEY" {
+			continue
+		}
+		// ToPEM writes RSA keys in PKCS#1 and EC keys in SEC 1
+		var key interface{}
+		if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+				return nil, errors.New("unsupported private key")
+			}
+		}
+		if block.Bytes, err = x509.MarshalPKCS8PrivateKey(key); err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
+
+// isCertificate reports whether block is a certificate, of the chain too.
+func isCertificate(block *pem.Block) bool {
+	return block.Type == "CERTIFICATE"
+}
+
+// isPrivateKey reports whether block is a private key of any format.
+func isPrivateKey(block *pem.Block) bool {
+	return strings.HasSuffix(block.Type, "PRIVATE KEY")
+}
@@ -0,0 +1,54 @@
+package render
+
+import (
+	"context"
+	"io"
+	"strings"
+	"text/template"
+)
+
+// Refs returns the distinct secrets referenced by the template read from
+// in, in order of appearance, without fetching them. References to the
+// default vault, and the vaults and names of kvName and kvNameVersion,
+// are returned as urls, and query options are removed.
+//
+// Only string literal references are returned, and included templates
+// and the named templates of Options.Templates are not followed.
+func (r *Renderer) Refs(in io.Reader) ([]string, error) {
+	lines, _, err := readLines(in)
+	if err != nil {
+		return nil, err
+	}
+	t := template.New(".env").Delims(r.opts.LeftDelim, r.opts.RightDelim).Funcs(funcMap(context.Background(), r.f, &source{}, r.opts))
+	if err := parseTemplates(t, r.opts.Templates); err != nil {
+		return nil, err
+	}
+	var refs []string
+	seen := map[string]bool{}
+	add := func(name, rawurl string) {
+		if u, err := r.f.parse(rawurl); err == nil && u != nil {
+			if _, err := parseRefOptions(u); err == nil {
+				rawurl = u.String()
+			}
+		}
+		if !seen[rawurl] {
+			seen[rawurl] = true
+			refs = append(refs, rawurl)
+		}
+	}
+	if r.opts.WholeFile {
+		tmpl, err := t.Parse(strings.Join(lines, "\n"))
+		if err != nil {
+			return nil, err
+		}
+		r.f.walkRefs(tmpl.Tree.Root, add)
+		return refs, nil
+	}
+	if r.opts.InlineComments {
+		for i, line := range lines {
+			lines[i], _ = splitInlineComment(line, r.opts.LeftDelim, r.opts.RightDelim)
+		}
+	}
+	r.f.refCalls(t, lines, add)
+	return refs, nil
+}
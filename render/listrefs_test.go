@@ -0,0 +1,44 @@
+package render
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestListRefs(t *testing.T) {
+	template := `# {{ kv "https://example.vault.azure.net/secrets/commented" }}
+USER=foo@example.com
+PASSWORD={{ kv "https://Example.vault.azure.net/secrets/pass" }}
+TRIMMED={{ kv "https://example.vault.azure.net/secrets/pass?trim=true" }}
+OPTIONAL={{ kvOr "https://example.vault.azure.net/secrets/missing" "none" }}
+NAMED={{ kvName "example" "db-password" }}
+DEFAULT={{ kv "api-key/v1" }}
+CERT={{ kvCert "https://example.vault.azure.net/secrets/cert-pem" }}
+AWS={{ kv "arn:aws:secretsmanager:us-east-1:123456789012:secret:db" }}
+COMPOSED={{ kv (printf "https://%s.vault.azure.net/secrets/pass" (env "VAULT")) }}
+`
+	client := &dummyClient{}
+	r, err := New(Options{Client: client, Credential: staticCredential("TOKEN"), DefaultVault: "example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs, err := r.Refs(strings.NewReader(template))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"https://example.vault.azure.net/secrets/pass",
+		"https://example.vault.azure.net/secrets/missing",
+		"https://example.vault.azure.net/secrets/db-password",
+		"https://example.vault.azure.net/secrets/api-key/v1",
+		"https://example.vault.azure.net/secrets/cert-pem",
+		"arn:aws:secretsmanager:us-east-1:123456789012:secret:db",
+	}
+	if !reflect.DeepEqual(refs, expected) {
+		t.Fatalf("got:%v want:%v", refs, expected)
+	}
+	if len(client.requests) != 0 {
+		t.Fatalf("got:%v want:no requests", client.requests)
+	}
+}
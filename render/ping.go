@@ -0,0 +1,45 @@
+package render
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ping authenticates to the Key Vault vault, a name or url, and lists a
+// secret of it. It returns the name of the credential used, which is that
+// of Options.Credential when it is set.
+func (f *fetcher) ping(ctx context.Context, vault string) (string, error) {
+	a := f.azure
+	if !strings.Contains(vault, "://") {
+		vault = "https://" + vault + "." + a.cloud.vaultSuffix
+	}
+	u, err := url.Parse(vault)
+	if err != nil {
+		return "", err
+	}
+	u = lowerHost(u)
+	if err := a.validateVault(u); err != nil {
+		return "", err
+	}
+	f.logger.Printf("pinging %s", u.Host)
+	var credential string
+	err = f.withTimeout(ctx, u.String(), func(ctx context.Context) error {
+		t, err := a.credentialFor(u.Hostname()).token(ctx, a.resource())
+		if err != nil {
+			return err
+		}
+		credential = t.provider
+		if credential == "" {
+			credential = "Options.Credential"
+		}
+		var page struct{}
+		err = a.get(ctx, "https://"+u.Host+"/secrets?maxresults=1&api-version=7.0", &page)
+		if e, ok := err.(*responseError); ok && e.statusCode == 403 {
+			return fmt.Errorf("%s is reachable with credential %s, but its secrets can not be listed: %v", u.Host, credential, err)
+		}
+		return err
+	})
+	return credential, err
+}
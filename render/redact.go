@@ -0,0 +1,38 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Redact copies the rendered .env read from in to out, replacing every
+// value of a KEY=value line that is a secret fetched by an earlier
+// render with its kv reference. It is the inverse of rendering, e.g. to
+// review a generated .env without the secrets.
+func (r *Renderer) Redact(in io.Reader, out io.Writer) error {
+	b, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	left, right := r.opts.LeftDelim, r.opts.RightDelim
+	if left == "" {
+		left = "{{"
+	}
+	if right == "" {
+		right = "}}"
+	}
+	var redacted bytes.Buffer
+	for _, line := range splitLines(b) {
+		if _, value, ok, err := parseLine(line); ok && err == nil {
+			if rawurl, ok := r.f.source(value); ok {
+				line = strings.TrimSuffix(line, value) + fmt.Sprintf("%s kv %q %s", left, rawurl, right)
+			}
+		}
+		redacted.WriteString(line + "\n")
+	}
+	_, err = out.Write(matchNewline(redacted.Bytes(), b))
+	return err
+}
@@ -0,0 +1,42 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	template := `USER=foo@example.com
+PASSWORD={{ kv "https://example.vault.azure.net/secrets/pass" }}
+EMPTY={{ kv "https://example.vault.azure.net/secrets/empty" }}
+`
+	rendered := `# generated
+USER=foo@example.com
+PASSWORD=mysecretvalue1
+export COPY=mysecretvalue1
+EMPTY=
+OTHER=mysecretvalue2`
+	expected := `# generated
+USER=foo@example.com
+PASSWORD={{ kv "https://example.vault.azure.net/secrets/pass" }}
+export COPY={{ kv "https://example.vault.azure.net/secrets/pass" }}
+EMPTY=
+OTHER=mysecretvalue2`
+	r, err := New(Options{Client: &dummyClient{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Render(context.Background(), strings.NewReader(template), ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := r.Redact(strings.NewReader(rendered), &b); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != expected {
+		t.Fatalf("got:%s want:%s", b.String(), expected)
+	}
+}
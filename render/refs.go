@@ -0,0 +1,182 @@
+package render
+
+import (
+	"context"
+	"text/template"
+	"text/template/parse"
+)
+
+// refFunc is a template function referencing a secret with its leading
+// string arguments.
+type refFunc struct {
+	// args is the number of the arguments making the reference.
+	args int
+	// ref returns the url referenced by args, the first one when nil.
+	ref func(a *azureBackend, args []string) string
+	// properties tells that the Key Vault properties of the secret, like
+	// its tags, are fetched instead of its value.
+	properties bool
+}
+
+// refFuncs are the template functions referencing a secret, whose string
+// literal references are listed by Refs, checked by Check, prefetched and
+// reported.
+var refFuncs = map[string]refFunc{
+	"kv":            {args: 1},
+	"kvOr":          {args: 1},
+	"kvJSON":        {args: 1},
+	"kvSplit":       {args: 1},
+	"kvFields":      {args: 1},
+	"kvFile":        {args: 1},
+	"kvTag":         {args: 1, properties: true},
+	"kvContentType": {args: 1, properties: true},
+	"kvCert":        {args: 1, properties: true},
+	"kvCertKey":     {args: 1, properties: true},
+	"kvName": {args: 2, ref: func(a *azureBackend, args []string) string {
+		return a.secretURL(args[0], args[1], "")
+	}},
+	"kvNameVersion": {args: 3, ref: func(a *azureBackend, args []string) string {
+		return a.secretURL(args[0], args[1], args[2])
+	}},
+}
+
+// secretRef is a secret referenced by a template, fetched for its
+// properties or for its value.
+type secretRef struct {
+	rawurl     string
+	properties bool
+}
+
+// refs returns the distinct secrets referenced with string literals by
+// refFuncs in lines, in order of appearance. Comments and lines that do
+// not parse are skipped.
+func (f *fetcher) refs(t *template.Template, lines []string) []secretRef {
+	return collectRefs(func(fn func(name, rawurl string)) {
+		f.refCalls(t, lines, fn)
+	})
+}
+
+// treeRefs is refs for the template parsed into root.
+func (f *fetcher) treeRefs(root parse.Node) []secretRef {
+	return collectRefs(func(fn func(name, rawurl string)) {
+		f.walkRefs(root, fn)
+	})
+}
+
+// collectRefs returns the distinct secrets of the calls walked by walk, in
+// order.
+func collectRefs(walk func(fn func(name, rawurl string))) []secretRef {
+	var refs []secretRef
+	seen := map[secretRef]bool{}
+	walk(func(name, rawurl string) {
+		ref := secretRef{rawurl, refFuncs[name].properties}
+		if !seen[ref] {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	})
+	return refs
+}
+
+// refCalls calls fn with the function name and the reference of every
+// call of refFuncs with string literals in lines.
+func (f *fetcher) refCalls(t *template.Template, lines []string, fn func(name, rawurl string)) {
+	for _, line := range lines {
+		if isComment(line) {
+			continue
+		}
+		tmpl, err := t.Parse(line)
+		if err != nil {
+			continue
+		}
+		f.walkRefs(tmpl.Tree.Root, fn)
+	}
+}
+
+// walkRefs calls fn with the function name and the reference of every
+// call of refFuncs with string literals under node.
+func (f *fetcher) walkRefs(node parse.Node, fn func(name, rawurl string)) {
+	f.walkRefNodes(node, func(name, rawurl string, pos parse.Pos) {
+		fn(name, rawurl)
+	})
+}
+
+// walkRefNodes is walkRefs with the position of the reference in the
+// template.
+func (f *fetcher) walkRefNodes(node parse.Node, fn func(name, rawurl string, pos parse.Pos)) {
+	walk(node, func(cmd *parse.CommandNode) {
+		if len(cmd.Args) < 2 {
+			return
+		}
+		ident, ok := cmd.Args[0].(*parse.IdentifierNode)
+		if !ok {
+			return
+		}
+		r, ok := refFuncs[ident.Ident]
+		if !ok || len(cmd.Args) < 1+r.args {
+			return
+		}
+		args := make([]string, r.args)
+		for i := range args {
+			s, ok := cmd.Args[1+i].(*parse.StringNode)
+			if !ok {
+				return
+			}
+			args[i] = s.Text
+		}
+		rawurl := args[0]
+		if r.ref != nil {
+			rawurl = r.ref(f.azure, args)
+		}
+		fn(ident.Ident, rawurl, cmd.Args[1].Position())
+	})
+}
+
+// load fetches the secret of ref, for its properties or for its value.
+func (f *fetcher) load(ctx context.Context, ref secretRef) error {
+	if ref.properties {
+		_, err := f.secretProperties(ctx, ref.rawurl)
+		return err
+	}
+	_, err := f.fetch(ctx, ref.rawurl)
+	return err
+}
+
+// walk calls fn for every command node under node.
+func walk(node parse.Node, fn func(*parse.CommandNode)) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			walk(c, fn)
+		}
+	case *parse.ActionNode:
+		walk(n.Pipe, fn)
+	case *parse.IfNode:
+		walk(&n.BranchNode, fn)
+	case *parse.RangeNode:
+		walk(&n.BranchNode, fn)
+	case *parse.WithNode:
+		walk(&n.BranchNode, fn)
+	case *parse.BranchNode:
+		walk(n.Pipe, fn)
+		walk(n.List, fn)
+		walk(n.ElseList, fn)
+	case *parse.TemplateNode:
+		walk(n.Pipe, fn)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			walk(c, fn)
+		}
+	case *parse.CommandNode:
+		fn(n)
+		for _, a := range n.Args {
+			walk(a, fn)
+		}
+	}
+}
@@ -0,0 +1,658 @@
+// Package render renders .env templates referencing secrets of Azure Key
+// Vault, HashiCorp Vault, AWS Secrets Manager and Google Secret Manager.
+package render
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// HTTPClient sends the requests to the secret stores and the identity
+// providers.
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Options configures a Renderer.
+type Options struct {
+	// Client sends the HTTP requests. When nil, an http.Client with the
+	// proxies of HTTPS_PROXY and NO_PROXY, trusting the CA certificates
+	// of VAULTENV_CA_BUNDLE too, is used.
+	Client HTTPClient
+	// Credential acquires the Azure AD tokens, the credential chain
+	// configured by the VAULTENV_AZURE_* environment variables when nil.
+	Credential TokenCredential
+	// CacheTokens stores the Azure AD tokens of the default credential
+	// chain in the user cache directory, readable only by the user, and
+	// reuses them until they expire.
+	CacheTokens bool
+	// CacheTTL stores the fetched secrets in the user cache directory,
+	// readable only by the user, and reuses them in later runs for CacheTTL
+	// after they were fetched. The secrets are not cached when 0.
+	CacheTTL time.Duration
+	// Interactive signs in a user with a device code, prompted on stderr,
+	// when no other credential of the default chain is available. The
+	// sign in must complete within Timeout.
+	Interactive bool
+	// AuthOrder names the credentials of the default chain to try, in
+	// order, among clientsecret, certificate, workload, managed, cli and
+	// devicecode, instead of VAULTENV_AUTH_ORDER or the default order.
+	// The credentials not named are never tried.
+	AuthOrder []string
+	// AuthTimeout bounds the requests of the managed identities to the
+	// identity endpoint when positive, so that the next credential is
+	// tried soon on machines outside of Azure.
+	AuthTimeout time.Duration
+	// Log receives the verbose messages about credentials, fetched
+	// secrets and timings when not nil. Values are never logged.
+	Log io.Writer
+	// Progress receives a counter of the prefetched secrets, like
+	// fetched 12/40 secrets, updated on a single line as the fetches
+	// complete and cleared at the end, when not nil. It never has secret
+	// names or values.
+	Progress io.Writer
+	// Timeout bounds the time spent fetching a secret when positive.
+	Timeout time.Duration
+	// Deadline bounds the time spent fetching all the secrets of a
+	// rendering when positive. The secrets not fetched by then fail.
+	Deadline time.Duration
+	// Transforms are the names of the transformers, built in or added by
+	// RegisterTransformer, applied in order to every fetched value.
+	Transforms []string
+	// SecretNewline normalizes the line endings of every fetched value
+	// before its transforms: lf turns CRLF and CR into LF, and strip
+	// removes them, for tokens that must be a single line. Empty keeps
+	// the values as is.
+	SecretNewline string
+	// DefaultVault is the Key Vault name, or url, of the references that
+	// are only secret names, like {{ kv "password" }}.
+	DefaultVault string
+	// VaultSuffixes replaces the DNS suffixes of the Key Vault hosts of
+	// the known clouds, like vault.azure.net, as the allowed vault hosts
+	// when set.
+	VaultSuffixes []string
+	// MaxRetries is the number of times a throttled or failed Key Vault
+	// request is retried.
+	MaxRetries int
+	// DryRun validates the template and the references instead of
+	// fetching the secrets.
+	DryRun bool
+	// AllowMissing renders secrets that do not exist as empty values,
+	// instead of failing. kvOr still returns its fallback.
+	AllowMissing bool
+	// Mask writes the fetched secrets as ******.
+	Mask bool
+	// NoCache fetches a secret for every reference to it, instead of once
+	// per Renderer, and disables prefetching. The secrets of CacheTTL are
+	// neither read nor stored.
+	NoCache bool
+
+	// KeepGoing continues with the remaining lines after a line fails,
+	// emitting the failed line unrendered.
+	KeepGoing bool
+	// Concurrency is the number of workers prefetching the kv
+	// references before rendering. Zero disables prefetching.
+	Concurrency int
+	// MaxPerVault limits the concurrent fetches from a single vault, on
+	// top of Concurrency, when positive.
+	MaxPerVault int
+	// LeftDelim and RightDelim replace the {{ and }} action delimiters
+	// when set.
+	LeftDelim, RightDelim string
+	// Format is the output format, dotenv, json or sh for shell export
+	// statements. Empty is dotenv.
+	Format string
+	// StripExport removes the export prefix of KEY=value lines in dotenv
+	// output.
+	StripExport bool
+	// EnvPrefix keeps only the KEY=value lines whose key has the prefix,
+	// and StripPrefix removes it from the keys.
+	EnvPrefix   string
+	StripPrefix bool
+	// OutputPrefix is prepended to the keys of the written KEY=value
+	// lines, after EnvPrefix is applied.
+	OutputPrefix string
+	// NoDuplicates fails when a key is defined more than once.
+	NoDuplicates bool
+	// ValidateKeys fails when a key is not a shell variable name, like
+	// MY-KEY or 123KEY.
+	ValidateKeys bool
+	// MergeEnv fills the KEY=value lines rendered with an empty value with
+	// the value of the environment variable KEY, when it is set, in line
+	// mode. Values rendered by the template win otherwise.
+	MergeEnv bool
+	// SortKeys sorts the KEY=value lines of the output by key, with the
+	// comments and blank lines before each line. JSON objects always
+	// have sorted keys.
+	SortKeys bool
+	// Merge keeps only the last definition of a key when rendering
+	// several files, so that later files override earlier ones.
+	Merge bool
+	// NoTrailingNewline removes the newline at the end of the output.
+	// Otherwise the output ends with a newline when the template does.
+	NoTrailingNewline bool
+	// WholeFile parses the whole template as one, instead of line by
+	// line, so that multi-line actions and structures like YAML block
+	// scalars are kept. Comment lines are rendered too.
+	WholeFile bool
+	// Templates are files of named templates, defined with define, that
+	// the template action of the input can execute.
+	Templates []string
+	// Quote wraps the values of KEY=value lines in double quotes in
+	// dotenv output.
+	Quote bool
+	// ValueOnly writes the rendered line of a single line template as is,
+	// without a newline, instead of a .env. It is meant for extracting a
+	// single secret in scripts.
+	ValueOnly bool
+	// MaxLineBytes limits the length of template lines in line mode, no
+	// limit when 0.
+	MaxLineBytes int
+	// Annotate appends a comment with the versions of the Key Vault
+	// secrets referenced in a line to the line, in line mode and dotenv
+	// output.
+	Annotate bool
+	// InlineComments ends the template of a line, in line mode, at an
+	// unquoted # preceded by white space, like PORT=8080 # the app port.
+	// The comment is written as is in dotenv output, and removed in the
+	// other formats.
+	InlineComments bool
+	// Report receives a JSON array of the results of the references
+	// rendered by Render and RenderFiles when not nil, like
+	// {"url":"...","line":1,"status":"error","error":"..."}. Values are
+	// never reported.
+	Report io.Writer
+
+	// crlf writes dotenv output with CRLF line endings, as the template
+	// has them.
+	crlf bool
+}
+
+// Renderer renders templates. It caches the fetched secrets for its
+// lifetime.
+type Renderer struct {
+	f    *fetcher
+	opts Options
+	// start is when the Renderer was created, for Summary.
+	start time.Time
+}
+
+// New returns a Renderer configured by opts.
+func New(opts Options) (*Renderer, error) {
+	if opts.Format != "" && opts.Format != "dotenv" && opts.Format != "json" && opts.Format != "sh" {
+		return nil, fmt.Errorf("unknown format %q", opts.Format)
+	}
+	if opts.ValueOnly && opts.Format != "" && opts.Format != "dotenv" {
+		return nil, fmt.Errorf("value only output can not be in %s format", opts.Format)
+	}
+	if opts.Annotate && ((opts.Format != "" && opts.Format != "dotenv") || opts.ValueOnly) {
+		return nil, fmt.Errorf("annotations are only written in dotenv format")
+	}
+	if opts.MergeEnv && opts.WholeFile {
+		return nil, fmt.Errorf("environment variables are only merged in line mode")
+	}
+	if opts.SecretNewline != "" && opts.SecretNewline != "lf" && opts.SecretNewline != "strip" {
+		return nil, fmt.Errorf("unknown secret newline %q, must be lf or strip", opts.SecretNewline)
+	}
+	for _, name := range opts.Transforms {
+		if _, err := lookupTransformer(name); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := azureCloudFromEnv(); err != nil {
+		return nil, err
+	}
+	client := opts.Client
+	if client == nil {
+		c, err := newHTTPClient()
+		if err != nil {
+			return nil, err
+		}
+		client = c
+	}
+	f := newFetcher(client)
+	var cache *tokenCache
+	if opts.CacheTokens {
+		c, err := newTokenCache()
+		if err != nil {
+			return nil, err
+		}
+		cache = c
+	}
+	if opts.Credential != nil {
+		f.azure.cred = credentialProvider{opts.Credential}
+	} else if c, ok := f.azure.cred.(*chainTokenProvider); ok {
+		deviceCode := &deviceCodeTokenProvider{
+			client:   client,
+			cloud:    f.azure.cloud,
+			tenant:   os.Getenv("VAULTENV_AZURE_TENANT"),
+			clientID: azureCliClientID,
+			prompt:   os.Stderr,
+		}
+		if len(opts.AuthOrder) > 0 {
+			providers, err := orderProviders(append(c.providers, deviceCode), opts.AuthOrder)
+			if err != nil {
+				return nil, err
+			}
+			c.providers = providers
+		} else if order := os.Getenv("VAULTENV_AUTH_ORDER"); order != "" {
+			providers, err := orderProviders(append(c.providers, deviceCode), strings.Split(order, ","))
+			if err != nil {
+				return nil, fmt.Errorf("VAULTENV_AUTH_ORDER: %v", err)
+			}
+			c.providers = providers
+		} else if opts.Interactive {
+			c.providers = append(c.providers, deviceCode)
+		}
+		for _, p := range c.providers {
+			if m, ok := p.(*managedIdentityTokenProvider); ok {
+				m.timeout = opts.AuthTimeout
+			}
+		}
+		c.cache = cache
+	}
+	creds, err := loadVaultCredentials(os.Getenv("VAULTENV_AZURE_VAULT_CREDENTIALS"), client, f.azure.cloud, f.logger, cache)
+	if err != nil {
+		return nil, err
+	}
+	f.azure.vaultCreds = creds
+	if opts.Log != nil {
+		f.logger.SetOutput(opts.Log)
+	}
+	f.dryRun = opts.DryRun
+	f.allowMissing = opts.AllowMissing
+	f.mask = opts.Mask
+	f.timeout = opts.Timeout
+	f.deadline = opts.Deadline
+	f.transforms = opts.Transforms
+	f.secretNewline = opts.SecretNewline
+	f.progress = opts.Progress
+	f.noCache = opts.NoCache
+	if opts.CacheTTL > 0 {
+		store, err := newSecretStore(opts.CacheTTL)
+		if err != nil {
+			return nil, err
+		}
+		f.store = store
+	}
+	f.maxPerVault = opts.MaxPerVault
+	f.azure.maxRetries = opts.MaxRetries
+	f.azure.suffixes = opts.VaultSuffixes
+	f.defaultVault = opts.DefaultVault
+	return &Renderer{f: f, opts: opts, start: time.Now()}, nil
+}
+
+// Render renders the template read from in to out. The errors of the
+// failing lines are reported together with their line numbers.
+func (r *Renderer) Render(ctx context.Context, in io.Reader, out io.Writer) error {
+	ctx, cancel := r.f.withDeadline(ctx)
+	defer cancel()
+	r.f.startReport(r.opts.Report != nil)
+	return r.writeReport(filter(ctx, r.f, in, out, r.opts))
+}
+
+// RenderFiles renders the template files paths in order to out as one
+// .env. With Options.Merge, the keys defined by later files override
+// those of earlier files.
+func (r *Renderer) RenderFiles(ctx context.Context, paths []string, out io.Writer) error {
+	ctx, cancel := r.f.withDeadline(ctx)
+	defer cancel()
+	r.f.startReport(r.opts.Report != nil)
+	return r.writeReport(filterFiles(ctx, r.f, paths, out, r.opts))
+}
+
+// Exec runs args with the KEY=value lines rendered from in added to the
+// environment, and returns the exit code of the command.
+func (r *Renderer) Exec(ctx context.Context, in io.Reader, args []string) (int, error) {
+	return execCommand(ctx, r.f, in, args, r.opts)
+}
+
+// Set stores value as a new version of the Key Vault secret rawurl, with
+// the credentials used to fetch secrets, and returns the version.
+func (r *Renderer) Set(ctx context.Context, rawurl, value string) (string, error) {
+	return r.f.set(ctx, rawurl, value)
+}
+
+// Ping checks that the Key Vault vault, a name or url, can be reached and
+// its secrets listed with the credentials, without a template. It returns
+// the name of the credential used, never a token.
+func (r *Renderer) Ping(ctx context.Context, vault string) (string, error) {
+	return r.f.ping(ctx, vault)
+}
+
+// Summary describes the secret fetches since the Renderer was created:
+// the number of secrets fetched, of vaults contacted and of cache hits,
+// and the time spent. It never includes secrets.
+func (r *Renderer) Summary() string {
+	return fmt.Sprintf("%s in %v", r.f.summary(), time.Since(r.start).Round(time.Millisecond))
+}
+
+// multiError collects the errors of every failing line so they can be
+// reported together.
+type multiError []error
+
+func (m multiError) Error() string {
+	var b strings.Builder
+	if len(m) == 1 {
+		b.WriteString("1 error occurred:")
+	} else {
+		fmt.Fprintf(&b, "%d errors occurred:", len(m))
+	}
+	for _, err := range m {
+		fmt.Fprintf(&b, "\n\t* %v", err)
+	}
+	return b.String()
+}
+
+func (m multiError) errorOrNil() error {
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+func filter(ctx context.Context, f *fetcher, in io.Reader, out io.Writer, opts Options) error {
+	src, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	opts.crlf = isCRLF(src)
+	var b bytes.Buffer
+	s := &source{}
+	renderErr := renderSource(ctx, f, s, bytes.NewReader(src), &b, opts)
+	if err := checkEnv([]renderedFile{{rendered: b.Bytes(), env: s.env}}, opts); err != nil {
+		return err
+	}
+	return writeEnv(out, b.Bytes(), s.env, renderErr, opts)
+}
+
+// filterFiles renders the template files paths in order as one .env.
+// Errors are reported with the path of their file.
+func filterFiles(ctx context.Context, f *fetcher, paths []string, out io.Writer, opts Options) error {
+	if opts.ValueOnly && len(paths) > 1 {
+		return fmt.Errorf("value only output needs a single template, got %d files", len(paths))
+	}
+	if len(paths) > 0 {
+		// the line endings of the first file are used, read errors are
+		// reported when it is rendered.
+		if b, err := ioutil.ReadFile(paths[0]); err == nil {
+			opts.crlf = isCRLF(b)
+		}
+	}
+	var files []renderedFile
+	var errs multiError
+	for _, path := range paths {
+		var b bytes.Buffer
+		env, err := renderFile(ctx, f, path, &b, opts)
+		files = append(files, renderedFile{name: path, rendered: b.Bytes(), env: env})
+		if err != nil {
+			if m, ok := err.(multiError); ok {
+				for _, err := range m {
+					errs = append(errs, fmt.Errorf("%s: %w", path, err))
+				}
+			} else {
+				errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			}
+			if !opts.KeepGoing {
+				break
+			}
+		}
+	}
+	if opts.NoDuplicates {
+		if opts.Merge {
+			for _, file := range files {
+				if err := checkDuplicateFiles([]renderedFile{file}, opts); err != nil {
+					return err
+				}
+			}
+		} else if err := checkDuplicateFiles(files, opts); err != nil {
+			return err
+		}
+	}
+	if opts.ValidateKeys {
+		if err := checkKeys(files, opts); err != nil {
+			return err
+		}
+	}
+	var b bytes.Buffer
+	var env []envLine
+	for i, file := range files {
+		b.Write(file.rendered)
+		if i < len(files)-1 && len(file.rendered) > 0 && !bytes.HasSuffix(file.rendered, []byte("\n")) {
+			b.WriteByte('\n')
+		}
+		env = append(env, file.env...)
+	}
+	rendered := b.Bytes()
+	if opts.Merge {
+		// merged on the entries, so that an overridden value spanning
+		// several lines is dropped whole
+		env = mergeEntries(env)
+		rendered = joinLines(env, rendered)
+	}
+	return writeEnv(out, rendered, env, errs.errorOrNil(), opts)
+}
+
+// writeEnv writes the rendered .env, whose lines as rendered are env, in
+// the format of opts. The output of a failed rendering is written in
+// dotenv format only.
+func writeEnv(out io.Writer, rendered []byte, env []envLine, renderErr error, opts Options) error {
+	if opts.ValueOnly {
+		if renderErr != nil {
+			return renderErr
+		}
+		_, err := out.Write(bytes.TrimSuffix(rendered, []byte("\n")))
+		return err
+	}
+	if opts.SortKeys {
+		rendered = sortEnv(rendered)
+		env = sortEntries(env)
+	}
+	var b bytes.Buffer
+	if opts.Format == "json" {
+		if renderErr != nil {
+			return renderErr
+		}
+		lines, err := envPairs(env)
+		if err != nil {
+			return err
+		}
+		if err := writeJSON(&b, selectEnv(lines, opts)); err != nil {
+			return err
+		}
+	} else if opts.Format == "sh" {
+		if renderErr != nil {
+			return renderErr
+		}
+		if err := writeSh(&b, env, rendered, opts); err != nil {
+			return err
+		}
+	} else if err := writeDotenv(&b, env, rendered, opts); err != nil {
+		return err
+	}
+	output := b.Bytes()
+	if opts.NoTrailingNewline {
+		output = bytes.TrimSuffix(output, []byte("\n"))
+	}
+	if opts.crlf && opts.Format != "json" && opts.Format != "sh" {
+		output = bytes.Replace(output, []byte("\n"), []byte("\r\n"), -1)
+	}
+	if _, err := out.Write(output); err != nil {
+		return err
+	}
+	return renderErr
+}
+
+// renderSource renders the template src read from in, collecting the
+// rendered .env lines in src.env.
+func renderSource(ctx context.Context, f *fetcher, src *source, in io.Reader, out io.Writer, opts Options) error {
+	funcs := funcMap(ctx, f, src, opts)
+	t := template.New(".env").Delims(opts.LeftDelim, opts.RightDelim).Funcs(funcs)
+	if err := parseTemplates(t, opts.Templates); err != nil {
+		return hintFuncs(err, funcs)
+	}
+	if opts.WholeFile {
+		return hintFuncs(renderWhole(ctx, f, src, t, in, out, opts), funcs)
+	}
+	lines, newline, err := readLines(in)
+	if err != nil {
+		return err
+	}
+	for i, line := range lines {
+		if opts.MaxLineBytes > 0 && len(line) > opts.MaxLineBytes {
+			return fmt.Errorf("line %d: longer than %d bytes", i+1, opts.MaxLineBytes)
+		}
+	}
+	if opts.ValueOnly && len(lines) > 1 {
+		return fmt.Errorf("value only output needs a single line template, got %d lines", len(lines))
+	}
+	comments := make([]string, len(lines))
+	if opts.InlineComments {
+		tmpls := make([]string, len(lines))
+		for i, line := range lines {
+			tmpls[i], comments[i] = splitInlineComment(line, opts.LeftDelim, opts.RightDelim)
+		}
+		lines = tmpls
+	}
+	if opts.Concurrency > 0 {
+		f.prefetch(ctx, f.refs(t, lines), opts.Concurrency)
+	}
+
+	var errs multiError
+	for i, line := range lines {
+		n := i + 1
+		if isComment(line) || line == "" {
+			io.WriteString(out, line)
+			src.env = append(src.env, envLine{n: n, line: line})
+		} else {
+			src.blocks = nil
+			b, err := render(t, line)
+			if f.reporting {
+				f.reportLine(src, t, n, line)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("line %d: %w", n, hintFuncs(err, funcs)))
+				if !opts.KeepGoing {
+					return errs
+				}
+				b = []byte(line)
+			} else if opts.MergeEnv {
+				b = mergeProcessEnv(b)
+			}
+			env := src.entries(n, line, b, opts)
+			if err == nil && opts.Quote && opts.Format != "json" && opts.Format != "sh" && isEnvLine(line, b) {
+				b = quoteValue(b)
+			}
+			// The comment is only written to the dotenv text: json, sh and
+			// exec use the values of src.env, collected without it.
+			if comments[i] != "" && !opts.ValueOnly && (opts.Format == "" || opts.Format == "dotenv") {
+				b = append(b, comments[i]...)
+			}
+			if err == nil && opts.Annotate {
+				b = annotate(f, t, line, b)
+			}
+			src.env = append(src.env, withText(env, b)...)
+			out.Write(b)
+		}
+		if i < len(lines)-1 || newline {
+			out.Write([]byte{'\n'})
+		}
+	}
+	return errs.errorOrNil()
+}
+
+// renderWhole renders in as a single template, so that actions and
+// comments can span lines. Nothing is written when it fails.
+func renderWhole(ctx context.Context, f *fetcher, src *source, t *template.Template, in io.Reader, out io.Writer, opts Options) error {
+	b, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	text := strings.Replace(string(b), "\r\n", "\n", -1)
+	tmpl, err := t.Parse(text)
+	if err != nil {
+		return parsed(err)
+	}
+	if opts.Concurrency > 0 {
+		f.prefetch(ctx, f.treeRefs(tmpl.Tree.Root), opts.Concurrency)
+	}
+	var rendered bytes.Buffer
+	err = tmpl.Execute(&rendered, nil)
+	if f.reporting {
+		f.reportTree(src, text, tmpl.Tree.Root)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch secret: %w", err)
+	}
+	src.env = textEntries(rendered.Bytes())
+	_, err = out.Write(rendered.Bytes())
+	return err
+}
+
+// renderFile renders the template file path, and returns its rendered
+// .env lines.
+func renderFile(ctx context.Context, f *fetcher, path string, out io.Writer, opts Options) ([]envLine, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(abs)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	src := &source{path: abs}
+	err = renderSource(ctx, f, src, file, out, opts)
+	return src.env, err
+}
+
+// readLines reads the lines of in without their newlines and reports
+// whether the last line ends with a newline.
+func readLines(in io.Reader) (lines []string, newline bool, err error) {
+	b, err := ioutil.ReadAll(in)
+	if err != nil || len(b) == 0 {
+		return nil, false, err
+	}
+	newline = b[len(b)-1] == '\n'
+	lines = strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines, newline, nil
+}
+
+// annotate appends the versions of the Key Vault secrets referenced in
+// line to its rendered b as a comment.
+func annotate(f *fetcher, t *template.Template, line string, b []byte) []byte {
+	var versions []string
+	for _, ref := range f.refs(t, []string{line}) {
+		if v, ok := f.version(ref.rawurl); ok {
+			versions = append(versions, v)
+		}
+	}
+	if len(versions) == 0 {
+		return b
+	}
+	return append(b, " # version="+strings.Join(versions, ",")...)
+}
+
+func render(t *template.Template, line string) ([]byte, error) {
+	tmpl, err := t.Parse(line)
+	if err != nil {
+		return nil, parsed(err)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, nil); err != nil {
+		return nil, fmt.Errorf("failed to fetch secret: %w", err)
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,95 @@
+package render
+
+import (
+	"encoding/json"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// refResult is the outcome of a reference of a template in the report of
+// Options.Report. It never has the value of the secret.
+type refResult struct {
+	File   string `json:"file,omitempty"`
+	URL    string `json:"url,omitempty"`
+	Line   int    `json:"line,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// startReport starts collecting the results of the references rendered
+// when reporting is set.
+func (f *fetcher) startReport(reporting bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reporting = reporting
+	f.report = nil
+}
+
+// reportLine adds the results of the references of line n of src to the
+// report.
+func (f *fetcher) reportLine(src *source, t *template.Template, n int, line string) {
+	f.refCalls(t, []string{line}, func(name, rawurl string) {
+		f.reportRef(src, n, name, rawurl)
+	})
+}
+
+// reportTree adds the results of the references of the whole template
+// text parsed into root to the report.
+func (f *fetcher) reportTree(src *source, text string, root parse.Node) {
+	f.walkRefNodes(root, func(name, rawurl string, pos parse.Pos) {
+		f.reportRef(src, 1+strings.Count(text[:pos], "\n"), name, rawurl)
+	})
+}
+
+// reportRef adds the result of the reference rawurl of the function name
+// at line n of src to the report. A reference that was not fetched, like
+// one in a branch not taken, is not reported, and a missing secret that
+// falls back is ok.
+func (f *fetcher) reportRef(src *source, n int, name, rawurl string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err, ok := f.results[rawurl]
+	if !ok {
+		return
+	}
+	r := refResult{File: src.path, URL: rawurl, Line: n, Status: "ok"}
+	if err != nil && !(isNotFound(err) && (name == "kvOr" || f.allowMissing)) {
+		r.Status = "error"
+		r.Error = err.Error()
+	}
+	f.report = append(f.report, r)
+}
+
+// writeReport writes the report of the rendering that returned err to
+// Options.Report as a JSON array, and returns err. A failure that is not
+// of a reference, like a template syntax error, is reported without url.
+func (r *Renderer) writeReport(err error) error {
+	if r.opts.Report == nil {
+		return err
+	}
+	r.f.mu.Lock()
+	report := append([]refResult{}, r.f.report...)
+	r.f.mu.Unlock()
+	if err != nil && !failed(report) {
+		report = append(report, refResult{Status: "error", Error: err.Error()})
+	}
+	b, jsonErr := json.Marshal(report)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	if _, werr := r.opts.Report.Write(append(b, '\n')); werr != nil && err == nil {
+		return werr
+	}
+	return err
+}
+
+// failed reports whether any reference of report failed.
+func failed(report []refResult) bool {
+	for _, r := range report {
+		if r.Status == "error" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package render
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// secretStore stores the fetched secrets in a file readable only by the
+// user, so that the next runs within ttl reuse them instead of fetching
+// them again.
+type secretStore struct {
+	path string
+	ttl  time.Duration
+	// warn reports a cache file that can not be read, once.
+	warn *log.Logger
+
+	mu     sync.Mutex
+	warned bool
+}
+
+// cachedSecret is an entry of the secret cache file.
+type cachedSecret struct {
+	Value     string `json:"value"`
+	FetchedAt int64  `json:"fetched_at"`
+}
+
+// newSecretStore returns the secret cache of ttl in the user cache
+// directory.
+func newSecretStore(ttl time.Duration) (*secretStore, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	return &secretStore{
+		path: filepath.Join(dir, "vaultenv", "secrets.json"),
+		ttl:  ttl,
+		warn: log.New(os.Stderr, "vaultenv: warning: ", 0),
+	}, nil
+}
+
+// load reads the cache file, empty when it does not exist or can not be
+// parsed.
+func (c *secretStore) load() map[string]cachedSecret {
+	secrets := map[string]cachedSecret{}
+	b, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return secrets
+	}
+	if err := json.Unmarshal(b, &secrets); err != nil {
+		if !c.warned {
+			c.warn.Printf("ignoring the secret cache %s: %v", c.path, err)
+			c.warned = true
+		}
+		return map[string]cachedSecret{}
+	}
+	return secrets
+}
+
+// fresh reports whether e was fetched within the ttl.
+func (c *secretStore) fresh(e cachedSecret) bool {
+	return time.Since(time.Unix(e.FetchedAt, 0)) < c.ttl
+}
+
+// get returns the secret cached for the url key, if fetched within the
+// ttl.
+func (c *secretStore) get(key string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.load()[key]
+	return e.Value, ok && c.fresh(e)
+}
+
+// put caches the secret v of the url key, dropping the stale secrets. The
+// file is read again just before being replaced through a temporary file,
+// so that it is never seen half written, but it is not locked: the secrets
+// put by another run in between are lost, the last writer wins, and are
+// only fetched again by the next run.
+func (c *secretStore) put(key, v string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	secrets := c.load()
+	for k, e := range secrets {
+		if !c.fresh(e) {
+			delete(secrets, k)
+		}
+	}
+	secrets[key] = cachedSecret{v, time.Now().Unix()}
+	return writeCacheFile(c.path, secrets)
+}
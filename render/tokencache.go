@@ -0,0 +1,116 @@
+package render
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// tokenExpiryMargin is the time left before the expiry of a token under
+// which it is not used anymore.
+const tokenExpiryMargin = 5 * time.Minute
+
+// valid reports whether t can still be used. A token of unknown expiry is
+// valid.
+func (t accessToken) valid() bool {
+	return t.expiresOn.IsZero() || time.Until(t.expiresOn) > tokenExpiryMargin
+}
+
+// cacheKey identifies the tokens of p for resource in the token cache, or
+// is empty when p can not be cached or is not configured.
+func cacheKey(p tokenProvider, resource string) string {
+	k, ok := p.(interface{ cacheKey() string })
+	if !ok || k.cacheKey() == "" {
+		return ""
+	}
+	return k.cacheKey() + " " + resource
+}
+
+// tokenCache stores access tokens with a known expiry in a file readable
+// only by the user, so that they are reused by the next runs.
+type tokenCache struct {
+	path string
+
+	mu sync.Mutex
+}
+
+// cachedToken is an entry of the token cache file.
+type cachedToken struct {
+	Token     string `json:"access_token"`
+	ExpiresOn int64  `json:"expires_on"`
+}
+
+// newTokenCache returns the token cache in the user cache directory.
+func newTokenCache() (*tokenCache, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	return &tokenCache{path: filepath.Join(dir, "vaultenv", "tokens.json")}, nil
+}
+
+func (c *tokenCache) load() map[string]cachedToken {
+	tokens := map[string]cachedToken{}
+	b, err := ioutil.ReadFile(c.path)
+	if err == nil {
+		json.Unmarshal(b, &tokens)
+	}
+	return tokens
+}
+
+// get returns the valid token cached for key.
+func (c *tokenCache) get(key string) (accessToken, bool) {
+	if c == nil || key == "" {
+		return accessToken{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.load()[key]
+	t := accessToken{value: e.Token, expiresOn: time.Unix(e.ExpiresOn, 0)}
+	return t, ok && t.valid()
+}
+
+// put caches t for key, dropping the expired tokens.
+func (c *tokenCache) put(key string, t accessToken) error {
+	if c == nil || key == "" || t.expiresOn.IsZero() {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tokens := c.load()
+	for k, e := range tokens {
+		if !(accessToken{expiresOn: time.Unix(e.ExpiresOn, 0)}).valid() {
+			delete(tokens, k)
+		}
+	}
+	tokens[key] = cachedToken{t.value, t.expiresOn.Unix()}
+	return writeCacheFile(c.path, tokens)
+}
+
+// writeCacheFile replaces the file path by v as JSON, creating the file
+// readable only by the user in a directory only accessible to the user.
+func writeCacheFile(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,87 @@
+package render
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Transformer changes the value of a secret after it is fetched, like
+// encoding a password to embed it in a connection string.
+type Transformer func(v string) (string, error)
+
+var (
+	transformersMu sync.RWMutex
+	transformers   = map[string]Transformer{
+		"base64d":    decodeBase64,
+		"jsonstring": jsonString,
+		"trim":       func(v string) (string, error) { return strings.TrimSpace(v), nil },
+		"urlencode":  func(v string) (string, error) { return url.QueryEscape(v), nil },
+	}
+)
+
+// RegisterTransformer makes t available by name to Options.Transforms and
+// to the transform query option of references. A transformer of the same
+// name is replaced.
+func RegisterTransformer(name string, t Transformer) {
+	transformersMu.Lock()
+	defer transformersMu.Unlock()
+	transformers[name] = t
+}
+
+// lookupTransformer returns the transformer registered by name.
+func lookupTransformer(name string) (Transformer, error) {
+	transformersMu.RLock()
+	defer transformersMu.RUnlock()
+	t, ok := transformers[name]
+	if !ok {
+		names := make([]string, 0, len(transformers))
+		for n := range transformers {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown transform %q, must be one of %s", name, strings.Join(names, ", "))
+	}
+	return t, nil
+}
+
+// transform applies the transformers names in order to the value v of
+// rawurl.
+func transform(names []string, rawurl, v string) (string, error) {
+	for _, name := range names {
+		t, err := lookupTransformer(name)
+		if err != nil {
+			return "", err
+		}
+		if v, err = t(v); err != nil {
+			return "", fmt.Errorf("secret %q: transform %s: %v", secretName(rawurl), name, err)
+		}
+	}
+	return v, nil
+}
+
+// decodeBase64 decodes v from the standard base64 encoding, ignoring its
+// surrounding white space.
+func decodeBase64(v string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// jsonString quotes v as a JSON string.
+func jsonString(v string) (string, error) {
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
@@ -0,0 +1,86 @@
+package render
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"strings"
+)
+
+// vaultCredential is the credential of the vaults whose host matches
+// pattern, like *.vault.azure.net, instead of the default chain.
+type vaultCredential struct {
+	pattern string
+	cred    tokenProvider
+}
+
+// vaultCredentialConfig is an entry of VAULTENV_AZURE_VAULT_CREDENTIALS,
+// a service principal of the tenant of the vaults matching Vault.
+type vaultCredentialConfig struct {
+	Vault            string `json:"vault"`
+	Tenant           string `json:"tenant"`
+	ClientID         string `json:"clientId"`
+	ClientSecret     string `json:"clientSecret"`
+	ClientSecretFile string `json:"clientSecretFile"`
+}
+
+// loadVaultCredentials returns the credentials of config, a JSON array of
+// vaultCredentialConfig or the file of it, in order. Each has its own
+// token cache, and uses the cache of tokens between runs when not nil.
+func loadVaultCredentials(config string, client HTTPClient, cloud azureCloud, logger *log.Logger, cache *tokenCache) ([]vaultCredential, error) {
+	if config == "" {
+		return nil, nil
+	}
+	data := []byte(config)
+	if !strings.HasPrefix(strings.TrimSpace(config), "[") {
+		b, err := ioutil.ReadFile(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read VAULTENV_AZURE_VAULT_CREDENTIALS: %v", err)
+		}
+		data = b
+	}
+	var configs []vaultCredentialConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("VAULTENV_AZURE_VAULT_CREDENTIALS is not a JSON array of credentials: %v", err)
+	}
+	creds := make([]vaultCredential, len(configs))
+	for i, c := range configs {
+		pattern := strings.ToLower(c.Vault)
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return nil, fmt.Errorf("VAULTENV_AZURE_VAULT_CREDENTIALS: credential %d: invalid vault pattern %q", i+1, c.Vault)
+		}
+		if c.Tenant == "" || c.ClientID == "" || (c.ClientSecret == "" && c.ClientSecretFile == "") {
+			return nil, fmt.Errorf("VAULTENV_AZURE_VAULT_CREDENTIALS: credential %d of %s: set tenant, clientId and clientSecret or clientSecretFile", i+1, c.Vault)
+		}
+		creds[i] = vaultCredential{
+			pattern: pattern,
+			cred: &chainTokenProvider{
+				providers: []tokenProvider{&clientSecretTokenProvider{
+					client:       client,
+					cloud:        cloud,
+					tenant:       c.Tenant,
+					clientID:     c.ClientID,
+					clientSecret: c.ClientSecret,
+					secretFile:   c.ClientSecretFile,
+				}},
+				logger: logger,
+				cache:  cache,
+				tokens: map[string]accessToken{},
+			},
+		}
+	}
+	return creds, nil
+}
+
+// credentialFor returns the credential of the vault host: the first of
+// vaultCreds matching it, or the default one.
+func (a *azureBackend) credentialFor(host string) tokenProvider {
+	for _, c := range a.vaultCreds {
+		if ok, _ := path.Match(c.pattern, strings.ToLower(host)); ok {
+			return c.cred
+		}
+	}
+	return a.cred
+}